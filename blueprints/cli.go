@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const cliUsage = `usage: ratelimiter [command] [flags]
+
+without command the proxy is started
+
+commands:
+  list [-banned]                       tracked ips
+  ban [-reason r] [-for 1h] <ip>       ban ip, without -for jail policy applies
+  unban <ip|cidr>                      forget ips
+  explain <ip>                         why ip is or isn't let through
+  routes                               routes and upstream health
+
+common flags:
+  -url     admin api url, defaults to ADMIN_URL or local ADMIN_ADDR, then http://127.0.0.1:8080
+  -token   bearer token, defaults to ADMIN_TOKEN
+  -json    print json instead of tables
+`
+
+var errUsage = errors.New("invalid usage")
+
+// cli holds flags shared by all subcommands
+type cli struct {
+	url   string
+	token string
+	json  bool
+	out   io.Writer
+}
+
+// adminURL derives admin api address of the local server from environment
+func adminURL() string {
+	if u := os.Getenv("ADMIN_URL"); u != "" {
+		return u
+	}
+	if addr := os.Getenv("ADMIN_ADDR"); addr != "" {
+		if strings.HasPrefix(addr, ":") {
+			addr = "127.0.0.1" + addr
+		}
+		return "http://" + addr
+	}
+	return "http://127.0.0.1:8080"
+}
+
+// runCLI executes admin subcommand, returns process exit code
+func runCLI(args []string, out io.Writer) int {
+	c := &cli{out: out}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), cliUsage) }
+	fs.StringVar(&c.url, "url", adminURL(), "admin api url")
+	fs.StringVar(&c.token, "token", os.Getenv("ADMIN_TOKEN"), "admin api token")
+	fs.BoolVar(&c.json, "json", false, "print json")
+
+	var run func(context.Context, *lib.AdminClient, []string) error
+	switch args[0] {
+	case "list":
+		banned := fs.Bool("banned", false, "only banned ips")
+		run = func(ctx context.Context, ac *lib.AdminClient, _ []string) error { return c.list(ctx, ac, *banned) }
+	case "ban":
+		reason := fs.String("reason", "", "ban reason")
+		dur := fs.Duration("for", 0, "ban duration")
+		run = func(ctx context.Context, ac *lib.AdminClient, a []string) error {
+			return c.ban(ctx, ac, a, *reason, *dur)
+		}
+	case "unban":
+		run = c.unban
+	case "explain":
+		run = c.explain
+	case "routes":
+		run = c.routes
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(out, cliUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], cliUsage)
+		return 2
+	}
+
+	pos, err := parseArgs(fs, args[1:])
+	if err != nil {
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err = run(ctx, lib.NewAdminClient(c.url, c.token), pos); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		if errors.Is(err, errUsage) {
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+// parseArgs parses flags placed before or after positional arguments, e.g. "ban 192.0.2.1 -for 1h",
+// flag package alone stops at the first positional one
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var pos []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return pos, nil
+		}
+		pos = append(pos, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func (c *cli) list(ctx context.Context, ac *lib.AdminClient, banned bool) error {
+	list, err := ac.List(ctx, banned)
+	if err != nil || c.json {
+		return c.printJSON(list, err)
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "IP\tBANNED\tREMAINING\tSTRIKES\tOFFENCES\tREASON")
+	for _, e := range list {
+		fmt.Fprintf(tw, "%s\t%t\t%s\t%s\t%d\t%s\n", e.IP, e.Banned, remaining(e.Remaining),
+			strconv.FormatFloat(e.Strikes, 'f', -1, 64), e.Offences, e.Reason)
+	}
+	return tw.Flush()
+}
+
+func (c *cli) ban(ctx context.Context, ac *lib.AdminClient, args []string, reason string, d time.Duration) error {
+	if len(args) != 1 {
+		return errors.Join(errUsage, errors.New("ban expects single ip"))
+	}
+	entry, err := ac.Ban(ctx, args[0], reason, d)
+	if err != nil || c.json {
+		return c.printJSON(entry, err)
+	}
+	_, err = fmt.Fprintf(c.out, "banned %s for %s\n", entry.IP, remaining(entry.Remaining))
+	return err
+}
+
+func (c *cli) unban(ctx context.Context, ac *lib.AdminClient, args []string) error {
+	if len(args) != 1 {
+		return errors.Join(errUsage, errors.New("unban expects single ip or cidr"))
+	}
+	n, err := ac.Unban(ctx, args[0])
+	if err != nil || c.json {
+		return c.printJSON(map[string]int{"removed": n}, err)
+	}
+	_, err = fmt.Fprintf(c.out, "removed %d records within %s\n", n, args[0])
+	return err
+}
+
+func (c *cli) explain(ctx context.Context, ac *lib.AdminClient, args []string) error {
+	if len(args) != 1 {
+		return errors.Join(errUsage, errors.New("explain expects single ip"))
+	}
+	ex, err := ac.Explain(ctx, args[0])
+	if err != nil || c.json {
+		return c.printJSON(ex, err)
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "ip\t%s\n", ex.IP)
+	fmt.Fprintf(tw, "verdict\t%s\n", ex.Verdict)
+	if ex.List != "" {
+		fmt.Fprintf(tw, "list\t%s (%s)\n", ex.List, ex.Prefix)
+	}
+	if e := ex.Tracked; e != nil {
+		fmt.Fprintf(tw, "strikes\t%s\n", strconv.FormatFloat(e.Strikes, 'f', -1, 64))
+		fmt.Fprintf(tw, "offences\t%d\n", e.Offences)
+		if !e.LastFail.IsZero() {
+			fmt.Fprintf(tw, "last failure\t%s\n", e.LastFail.Format(time.RFC3339))
+		}
+		if e.Banned {
+			fmt.Fprintf(tw, "banned until\t%s (%s)\n", e.Until.Format(time.RFC3339), remaining(e.Remaining))
+			fmt.Fprintf(tw, "reason\t%s\n", e.Reason)
+		}
+	}
+	return tw.Flush()
+}
+
+func (c *cli) routes(ctx context.Context, ac *lib.AdminClient, _ []string) error {
+	list, err := ac.Routes(ctx)
+	if err != nil || c.json {
+		return c.printJSON(list, err)
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROUTE\tMETHODS\tLIMIT\tPOLICY\tTARGET\tHEALTHY\tACTIVE")
+	for _, r := range list {
+		methods := strings.Join(r.Methods, ",")
+		if methods == "" {
+			methods = "*"
+		}
+		limit := r.Limit
+		if limit == "" {
+			limit = "default"
+		}
+		for i, t := range r.Targets {
+			name := r.Name
+			if i > 0 {
+				name, methods, limit = "", "", ""
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%t\t%d\n", name, methods, limit, r.Policy, t.URL, t.Healthy, t.Active)
+		}
+	}
+	return tw.Flush()
+}
+
+// printJSON prints v unless request failed
+func (c *cli) printJSON(v any, err error) error {
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// remaining formats whole seconds left, rounded up so bans ending within a second still show
+func remaining(seconds float64) string {
+	if seconds <= 0 {
+		return "-"
+	}
+	return (time.Duration(math.Ceil(seconds)) * time.Second).String()
+}
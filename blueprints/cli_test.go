@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCLI(t *testing.T) {
+	blocker := lib.NewIPBlocker(3, time.Hour, lib.JailPolicy{}, 0)
+	srv := httptest.NewServer(lib.NewAdmin(blocker, lib.NewAccessLists(), lib.NewRouteTable(), "secret"))
+	defer srv.Close()
+	blocker.NotifyFailure("198.51.100.1", 1)
+
+	run := func(args ...string) (int, string) {
+		var out bytes.Buffer
+		code := runCLI(append(args, "-url", srv.URL, "-token", "secret"), &out)
+		return code, out.String()
+	}
+
+	tests := []struct {
+		args []string
+		code int
+		want []string
+	}{
+		// flags are accepted after the ip
+		{[]string{"ban", "203.0.113.1", "-for", "1h", "-reason", "manual"}, 0, []string{"banned 203.0.113.1 for 1h0m0s"}},
+		{[]string{"ban", "-reason", "manual", "203.0.113.2"}, 0, []string{"banned 203.0.113.2 for 1h0m0s"}},
+		{[]string{"list", "-banned"}, 0, []string{
+			"IP           BANNED  REMAINING  STRIKES  OFFENCES  REASON",
+			"203.0.113.1  true    1h0m0s     0        1         admin: manual",
+		}},
+		{[]string{"list"}, 0, []string{"198.51.100.1  false   -          1        0"}},
+		{[]string{"explain", "203.0.113.1"}, 0, []string{"verdict", "reason        admin: manual"}},
+		{[]string{"unban", "203.0.113.0/24"}, 0, []string{"removed 2 records within 203.0.113.0/24"}},
+		{[]string{"list", "-json", "-banned"}, 0, []string{"[]"}},
+		{[]string{"ban"}, 2, nil},
+		{[]string{"ban", "203.0.113.1", "203.0.113.2"}, 2, nil},
+		{[]string{"ban", "203.0.113.1", "-for"}, 2, nil},
+		{[]string{"bogus"}, 2, nil},
+	}
+	for _, tt := range tests {
+		code, out := run(tt.args...)
+		if code != tt.code {
+			t.Errorf("%v exited with %d, output %q", tt.args, code, out)
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(out, w) {
+				t.Errorf("%v output %q misses %q", tt.args, out, w)
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if code := runCLI([]string{"list", "-url", srv.URL, "-token", "wrong"}, &out); code != 1 {
+		t.Errorf("unauthorized list exited with %d", code)
+	}
+}
+
+func TestRemaining(t *testing.T) {
+	tests := map[float64]string{
+		0:      "-",
+		-1:     "-",
+		0.9:    "1s",
+		59.1:   "1m0s",
+		3600:   "1h0m0s",
+		3599.2: "1h0m0s",
+	}
+	for in, want := range tests {
+		if got := remaining(in); got != want {
+			t.Errorf("remaining(%v) got %s want %s", in, got, want)
+		}
+	}
+}
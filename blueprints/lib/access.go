@@ -0,0 +1,294 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	core "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	ListAllow = "allow"
+	ListDeny  = "deny"
+	// ListAdmin is name of allowlist managed through admin api
+	ListAdmin = "admin"
+
+	configMapListPrefix = "configmap:"
+)
+
+// ListSource provides content of a prefix list
+type ListSource interface {
+	Load(ctx context.Context) ([]byte, error)
+}
+
+// FileSource reads list from file, e.g. mounted ConfigMap
+type FileSource string
+
+func (f FileSource) Load(_ context.Context) ([]byte, error) {
+	return os.ReadFile(string(f))
+}
+
+// ConfigMapSource reads list from all keys of a ConfigMap, in key order
+type ConfigMapSource struct {
+	cm   core.ConfigMapInterface
+	name string
+}
+
+func NewConfigMapSource(cm core.ConfigMapInterface, name string) *ConfigMapSource {
+	return &ConfigMapSource{cm: cm, name: name}
+}
+
+func (c *ConfigMapSource) Load(ctx context.Context) ([]byte, error) {
+	cm, err := c.cm.Get(ctx, c.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(cm.Data))
+	for k := range cm.Data {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		buf.WriteString(cm.Data[k])
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// ParsePrefixes reads one address or cidr per line, text after '#' or ';' is a comment,
+// invalid lines are skipped and counted
+func ParsePrefixes(r io.Reader) ([]netip.Prefix, int, error) {
+	var (
+		prefixes []netip.Prefix
+		invalid  int
+	)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		p, err := ParsePrefix(strings.Fields(line)[0])
+		if err != nil {
+			invalid++
+			continue
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, invalid, sc.Err()
+}
+
+// PrefixList is named prefix set kept in sync with its source
+type PrefixList struct {
+	Name string
+	*PrefixSet
+
+	source ListSource
+	sum    [sha256.Size]byte
+}
+
+func NewPrefixList(name string, source ListSource) *PrefixList {
+	return &PrefixList{Name: name, PrefixSet: NewPrefixSet(), source: source}
+}
+
+// Reload loads source and replaces content if it changed, on error previous content is kept,
+// lists without source are maintained by their owner
+func (l *PrefixList) Reload(ctx context.Context) (bool, error) {
+	if l.source == nil {
+		return false, nil
+	}
+	data, err := l.source.Load(ctx)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(data)
+	if sum == l.sum {
+		return false, nil
+	}
+
+	prefixes, invalid, err := ParsePrefixes(bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	if invalid > 0 {
+		slog.Warn("skipped invalid list entries", "list", l.Name, "val", invalid)
+	}
+	l.Replace(prefixes)
+	l.sum = sum
+	slog.Info("prefix list loaded", "list", l.Name, "val", len(prefixes))
+	return true, nil
+}
+
+// AccessLists are allow and deny lists checked before bans and rate limits, allow wins
+type AccessLists struct {
+	// Admin is runtime allowlist managed through admin api
+	Admin *PrefixSet
+
+	allow []*PrefixList
+	deny  []*PrefixList
+	feeds []*Feed
+}
+
+func NewAccessLists() *AccessLists {
+	return &AccessLists{Admin: NewPrefixSet()}
+}
+
+// LoadAccessLists creates lists from ALLOW_LISTS and DENY_LISTS, entries are file paths or
+// configmap:<name>, sources failing to load start empty and are retried by Run. Reputation
+// feeds from FEEDS are checked after deny lists.
+func LoadAccessLists(ctx context.Context, vars *EnvVars) (*AccessLists, error) {
+	a := NewAccessLists()
+	feeds, err := ParseFeeds(vars.Feeds)
+	if err != nil {
+		return nil, err
+	}
+
+	var cm core.ConfigMapInterface
+	source := func(spec string) (ListSource, error) {
+		name, ok := strings.CutPrefix(spec, configMapListPrefix)
+		if !ok {
+			return FileSource(spec), nil
+		}
+		if cm == nil {
+			var err error
+			if cm, err = initConfigMapClient(vars.Namespace); err != nil {
+				return nil, err
+			}
+		}
+		return NewConfigMapSource(cm, name), nil
+	}
+
+	for _, kind := range []struct {
+		specs []string
+		add   func(*PrefixList)
+	}{
+		{vars.AllowLists, a.AddAllow},
+		{vars.DenyLists, a.AddDeny},
+	} {
+		for _, spec := range kind.specs {
+			src, err := source(spec)
+			if err != nil {
+				return nil, err
+			}
+			l := NewPrefixList(spec, src)
+			if _, err = l.Reload(ctx); err != nil {
+				slog.Error("loading prefix list", "list", spec, "val", err.Error())
+			}
+			kind.add(l)
+		}
+	}
+	for _, f := range feeds {
+		a.AddFeed(f)
+	}
+	return a, nil
+}
+
+func (a *AccessLists) AddAllow(l *PrefixList) {
+	a.allow = append(a.allow, l)
+}
+
+func (a *AccessLists) AddDeny(l *PrefixList) {
+	a.deny = append(a.deny, l)
+}
+
+// AddFeed adds deny list of feed, feed is refreshed by Run
+func (a *AccessLists) AddFeed(f *Feed) {
+	a.feeds = append(a.feeds, f)
+	a.deny = append(a.deny, f.List())
+}
+
+func (a *AccessLists) Feeds() []*Feed {
+	if a == nil {
+		return nil
+	}
+	return a.feeds
+}
+
+// Allowed returns name of the first allowlist containing addr and matched prefix
+func (a *AccessLists) Allowed(addr netip.Addr) (string, netip.Prefix, bool) {
+	if a == nil {
+		return "", netip.Prefix{}, false
+	}
+	if p, ok := a.Admin.Lookup(addr); ok {
+		return ListAdmin, p, true
+	}
+	return lookupLists(a.allow, addr)
+}
+
+// AllowedPrefix returns name of the first allowlist overlapping p and the overlapping prefix
+func (a *AccessLists) AllowedPrefix(p netip.Prefix) (string, netip.Prefix, bool) {
+	if a == nil {
+		return "", netip.Prefix{}, false
+	}
+	if q, ok := a.Admin.Overlaps(p); ok {
+		return ListAdmin, q, true
+	}
+	for _, l := range a.allow {
+		if q, ok := l.Overlaps(p); ok {
+			return l.Name, q, true
+		}
+	}
+	return "", netip.Prefix{}, false
+}
+
+// Denied returns name of the first denylist containing addr and matched prefix
+func (a *AccessLists) Denied(addr netip.Addr) (string, netip.Prefix, bool) {
+	if a == nil {
+		return "", netip.Prefix{}, false
+	}
+	return lookupLists(a.deny, addr)
+}
+
+// Run reloads lists every interval and refreshes feeds on their own intervals until ctx is done
+func (a *AccessLists) Run(ctx context.Context, interval time.Duration) {
+	for _, f := range a.feeds {
+		go f.Run(ctx)
+	}
+
+	lists := slices.Concat(a.allow, a.deny)
+	if interval <= 0 || len(lists) == 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			for _, l := range lists {
+				rctx, cancel := context.WithTimeout(ctx, interval)
+				if _, err := l.Reload(rctx); err != nil && !errors.Is(err, context.Canceled) {
+					slog.Error("reloading prefix list, keeping previous", "list", l.Name, "val", err.Error())
+				}
+				cancel()
+			}
+		}
+	}
+}
+
+func lookupLists(lists []*PrefixList, addr netip.Addr) (string, netip.Prefix, bool) {
+	for _, l := range lists {
+		if p, ok := l.Lookup(addr); ok {
+			return l.Name, p, true
+		}
+	}
+	return "", netip.Prefix{}, false
+}
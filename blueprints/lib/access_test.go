@@ -0,0 +1,147 @@
+package lib_test
+
+import (
+	"context"
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	list := `# lan
+192.168.0.0/16
+100.64.0.0/10   ; tailscale
+  203.0.113.7 probe
+2001:db8::/32
+not-an-ip
+`
+	prefixes, invalid, err := lib.ParsePrefixes(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prefixes) != 4 || invalid != 1 {
+		t.Fatalf("parsed %v, %d invalid", prefixes, invalid)
+	}
+
+	set := lib.NewPrefixSet(prefixes...)
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"192.168.1.1", true},
+		{"100.100.1.1", true},
+		{"203.0.113.7", true},
+		{"203.0.113.8", false},
+		{"2001:db8::1", true},
+		{"::ffff:192.168.3.4", true},
+		{"10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := set.Contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("%s: got %t", tt.addr, got)
+		}
+	}
+}
+
+func TestPrefixListReload(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(path, []byte("198.51.100.0/24\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	l := lib.NewPrefixList("deny", lib.FileSource(path))
+	if changed, err := l.Reload(ctx); err != nil || !changed || l.Len() != 1 {
+		t.Fatalf("initial load: %t %v", changed, err)
+	}
+	if changed, _ := l.Reload(ctx); changed {
+		t.Error("unchanged file reloaded")
+	}
+
+	if err := os.WriteFile(path, []byte("198.51.100.0/24\n203.0.113.0/24\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := l.Reload(ctx); err != nil || !changed || l.Len() != 2 {
+		t.Errorf("changed file: %t %v, %d entries", changed, err, l.Len())
+	}
+
+	// previous content survives failing source
+	_ = os.Remove(path)
+	if _, err := l.Reload(ctx); err == nil || l.Len() != 2 {
+		t.Errorf("missing file: %v, %d entries", err, l.Len())
+	}
+
+	cm := fake.NewClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "allow", Namespace: "ratelimiter"},
+		Data:       map[string]string{"lan": "192.168.0.0/16", "probes": "203.0.113.7"},
+	}).CoreV1().ConfigMaps("ratelimiter")
+	cl := lib.NewPrefixList("configmap:allow", lib.NewConfigMapSource(cm, "allow"))
+	if _, err := cl.Reload(ctx); err != nil || cl.Len() != 2 {
+		t.Errorf("configmap list: %v, %d entries", err, cl.Len())
+	}
+}
+
+func TestRouterAccessLists(t *testing.T) {
+	vars := &lib.EnvVars{BucketLimit: 1, BucketRate: 1, BannedStatus: http.StatusForbidden}
+	blocker := lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{}, 0)
+
+	dir := t.TempDir()
+	allowPath, denyPath := filepath.Join(dir, "allow"), filepath.Join(dir, "deny")
+	_ = os.WriteFile(allowPath, []byte("192.168.0.0/16\n"), 0o600)
+	_ = os.WriteFile(denyPath, []byte("192.168.5.0/24\n198.51.100.0/24\n"), 0o600)
+	vars.AllowLists, vars.DenyLists = []string{allowPath}, []string{denyPath}
+	lists, err := lib.LoadAccessLists(context.Background(), vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := echoServer("backend")
+	defer backend.Close()
+	targets, _ := lib.ParseTargets(backend.URL)
+	routes := lib.NewRouteTable()
+	_ = routes.Add("example.com", &lib.Route{Prefix: "/", Pool: lib.NewPool("", targets)})
+	m := testMetrics()
+	handler := lib.InitServer(blocker, lib.NewBucket(vars), vars, m, routes, nil, lists).Handler
+
+	get := func(ip string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// allow wins over deny, skips rate limit
+	for range 3 {
+		if code := get("192.168.5.1"); code != http.StatusOK {
+			t.Fatalf("allowlisted ip got %d", code)
+		}
+	}
+	if code := get("198.51.100.9"); code != http.StatusForbidden {
+		t.Errorf("denylisted ip got %d", code)
+	}
+	if code := get("203.0.113.1"); code != http.StatusOK {
+		t.Errorf("unlisted ip got %d", code)
+	}
+
+	if n := testutil.ToFloat64(m.ListHits.WithLabelValues(allowPath, lib.ListAllow)); n != 3 {
+		t.Errorf("allow hits %v", n)
+	}
+	if n := testutil.ToFloat64(m.ListHits.WithLabelValues(denyPath, lib.ListDeny)); n != 1 {
+		t.Errorf("deny hits %v", n)
+	}
+	if blocker.Len() != 0 {
+		t.Error("listed ips reached ip blocker")
+	}
+}
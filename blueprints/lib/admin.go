@@ -0,0 +1,343 @@
+package lib
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// AdminEntry is tracked ip as reported by admin api
+type AdminEntry struct {
+	BlockEntry
+	Banned    bool    `json:"banned"`
+	Remaining float64 `json:"remaining_seconds,omitempty"`
+}
+
+// AdminBan is manual ban request, empty duration escalates by jail policy
+type AdminBan struct {
+	IP       string `json:"ip"`
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"`
+}
+
+// AdminAllow is allowlist change request, ip or cidr
+type AdminAllow struct {
+	CIDR string `json:"cidr"`
+}
+
+// AdminExplain tells why requests of ip are or aren't let through, List and Prefix name the
+// allow or deny list entry which matched
+type AdminExplain struct {
+	IP      string      `json:"ip"`
+	Verdict string      `json:"verdict"`
+	List    string      `json:"list,omitempty"`
+	Prefix  string      `json:"prefix,omitempty"`
+	Tracked *AdminEntry `json:"tracked,omitempty"`
+}
+
+// Explain verdicts
+const (
+	VerdictAllowed = "allowed"
+	VerdictDenied  = "denied"
+	VerdictBanned  = "banned"
+	VerdictTracked = "tracked"
+	VerdictClean   = "clean"
+)
+
+type AdminRoute struct {
+	Name    string        `json:"name"`
+	Pattern string        `json:"pattern"`
+	Methods []string      `json:"methods,omitempty"`
+	Strip   bool          `json:"strip,omitempty"`
+	Rewrite string        `json:"rewrite,omitempty"`
+	Policy  string        `json:"policy,omitempty"`
+	Limit   string        `json:"limit,omitempty"`
+	Targets []AdminTarget `json:"targets"`
+}
+
+type AdminTarget struct {
+	URL     string `json:"url"`
+	Healthy bool   `json:"healthy"`
+	Active  int64  `json:"active"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+type adminCount struct {
+	Removed int `json:"removed"`
+}
+
+type Admin struct {
+	filter ClientFilter
+	lists  *AccessLists
+	routes *RouteTable
+	token  []byte
+}
+
+// NewAdmin creates json admin api protected by bearer token, mutations are accepted only on
+// POST and DELETE
+//
+//	GET    /admin/ips[?banned=true]  tracked ips
+//	GET    /admin/ips/{ip}           single ip
+//	GET    /admin/explain/{ip}       verdict for ip
+//	GET    /admin/routes             routes and upstream health
+//	DELETE /admin/ips                forget all ips
+//	POST   /admin/bans               ban ip, body AdminBan
+//	DELETE /admin/bans?target=cidr   unban ip or cidr
+//	GET    /admin/allow              runtime allowlist
+//	POST   /admin/allow              add to allowlist, body AdminAllow
+//	DELETE /admin/allow?target=cidr  remove from allowlist
+//
+// Runtime allowlist lives in memory of the replica serving the request, it is neither shared
+// through valkey nor persisted, so it is lost on restart and every replica has to be changed on
+// its own. Lasting entries belong to ALLOW_LISTS.
+func NewAdmin(filter ClientFilter, lists *AccessLists, routes *RouteTable, token string) http.Handler {
+	a := &Admin{filter: filter, lists: lists, routes: routes, token: []byte(token)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/ips", a.listIPs)
+	mux.HandleFunc("GET /admin/ips/{ip}", a.getIP)
+	mux.HandleFunc("GET /admin/explain/{ip}", a.explain)
+	mux.HandleFunc("GET /admin/routes", a.listRoutes)
+	mux.HandleFunc("DELETE /admin/ips", a.reset)
+	mux.HandleFunc("POST /admin/bans", a.ban)
+	mux.HandleFunc("DELETE /admin/bans", a.unban)
+	mux.HandleFunc("GET /admin/allow", a.listAllow)
+	mux.HandleFunc("POST /admin/allow", a.addAllow)
+	mux.HandleFunc("DELETE /admin/allow", a.removeAllow)
+
+	return a.authorized(mux)
+}
+
+// InitAdmin creates server for admin api on its own address
+func InitAdmin(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: 2 * time.Second,
+		WriteTimeout:      5 * time.Second,
+		IdleTimeout:       180 * time.Second,
+	}
+}
+
+func (a *Admin) authorized(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || len(a.token) == 0 || subtle.ConstantTimeCompare([]byte(token), a.token) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ratelimiter"`)
+			writeJSON(w, http.StatusUnauthorized, adminError{Error: "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *Admin) listIPs(w http.ResponseWriter, r *http.Request) {
+	bannedOnly := r.URL.Query().Get("banned") == "true"
+	now := time.Now()
+
+	list := make([]AdminEntry, 0)
+	for _, e := range a.filter.List() {
+		entry := newAdminEntry(e, now)
+		if bannedOnly && !entry.Banned {
+			continue
+		}
+		list = append(list, entry)
+	}
+	slices.SortFunc(list, func(x, y AdminEntry) int { return strings.Compare(x.IP, y.IP) })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (a *Admin) getIP(w http.ResponseWriter, r *http.Request) {
+	addr, err := netip.ParseAddr(r.PathValue("ip"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+		return
+	}
+	if entry := a.tracked(addr); entry != nil {
+		writeJSON(w, http.StatusOK, entry)
+		return
+	}
+	writeJSON(w, http.StatusNotFound, adminError{Error: "ip not tracked"})
+}
+
+// tracked returns record of addr, record may be keyed by client prefix containing it
+func (a *Admin) tracked(addr netip.Addr) *AdminEntry {
+	addr = addr.Unmap()
+	for _, e := range a.filter.List() {
+		if key, err := ParsePrefix(e.IP); err == nil && key.Contains(addr) {
+			entry := newAdminEntry(e, time.Now())
+			return &entry
+		}
+	}
+	return nil
+}
+
+func (a *Admin) explain(w http.ResponseWriter, r *http.Request) {
+	addr, err := netip.ParseAddr(r.PathValue("ip"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+		return
+	}
+	ex := AdminExplain{IP: addr.Unmap().String(), Verdict: VerdictClean, Tracked: a.tracked(addr)}
+	if ex.Tracked != nil {
+		ex.Verdict = VerdictTracked
+		if ex.Tracked.Banned {
+			ex.Verdict = VerdictBanned
+		}
+	}
+	// same order as router, allowlists win over denylists and bans
+	if list, p, ok := a.lists.Allowed(addr); ok {
+		ex.Verdict, ex.List, ex.Prefix = VerdictAllowed, list, p.String()
+	} else if list, p, ok = a.lists.Denied(addr); ok {
+		ex.Verdict, ex.List, ex.Prefix = VerdictDenied, list, p.String()
+	}
+	writeJSON(w, http.StatusOK, ex)
+}
+
+func (a *Admin) listRoutes(w http.ResponseWriter, _ *http.Request) {
+	routes := a.routes.Routes()
+	list := make([]AdminRoute, 0, len(routes))
+	for _, rt := range routes {
+		ar := AdminRoute{
+			Name:    rt.Name,
+			Pattern: rt.pattern(),
+			Methods: rt.Methods,
+			Strip:   rt.Strip,
+			Rewrite: rt.Rewrite,
+			Policy:  rt.Pool.Policy(),
+			Targets: make([]AdminTarget, 0, len(rt.Pool.Targets)),
+		}
+		if rt.Limit != nil {
+			ar.Limit = rt.Limit.String()
+		}
+		for _, u := range rt.Pool.Targets {
+			ar.Targets = append(ar.Targets, AdminTarget{URL: u.URL.String(), Healthy: u.Healthy(), Active: u.Active()})
+		}
+		list = append(list, ar)
+	}
+	slices.SortStableFunc(list, func(x, y AdminRoute) int { return strings.Compare(x.Name, y.Name) })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (a *Admin) reset(w http.ResponseWriter, _ *http.Request) {
+	n := a.filter.Len()
+	a.filter.Reset()
+	slog.Warn("ip blocker reset by admin", "records", n)
+	writeJSON(w, http.StatusOK, adminCount{Removed: n})
+}
+
+func (a *Admin) ban(w http.ResponseWriter, r *http.Request) {
+	var req AdminBan
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: "invalid body: " + err.Error()})
+		return
+	}
+	addr, err := netip.ParseAddr(req.IP)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+		return
+	}
+	var d time.Duration
+	if req.Duration != "" {
+		if d, err = time.ParseDuration(req.Duration); err != nil || d <= 0 {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: "invalid duration " + req.Duration})
+			return
+		}
+	}
+	reason := "admin"
+	if req.Reason != "" {
+		reason = "admin: " + req.Reason
+	}
+
+	ip := addr.Unmap().String()
+	a.filter.Ban(ip, d, reason)
+	writeJSON(w, http.StatusCreated, AdminEntry{
+		BlockEntry: BlockEntry{IP: ip, Reason: reason},
+		Banned:     true,
+		Remaining:  a.filter.BannedFor(ip).Seconds(),
+	})
+}
+
+func (a *Admin) unban(w http.ResponseWriter, r *http.Request) {
+	p, ok := targetPrefix(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, adminCount{Removed: a.filter.Unban(p)})
+}
+
+func (a *Admin) listAllow(w http.ResponseWriter, _ *http.Request) {
+	list := make([]string, 0, a.lists.Admin.Len())
+	for _, p := range a.lists.Admin.List() {
+		list = append(list, p.String())
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// addAllow allowlists prefix on this replica only, until restart
+func (a *Admin) addAllow(w http.ResponseWriter, r *http.Request) {
+	var req AdminAllow
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: "invalid body: " + err.Error()})
+		return
+	}
+	p, err := ParsePrefix(req.CIDR)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+		return
+	}
+	a.lists.Admin.Add(p)
+	slog.Warn("allowlisted by admin", lIP, p.String())
+	writeJSON(w, http.StatusCreated, AdminAllow{CIDR: p.String()})
+}
+
+func (a *Admin) removeAllow(w http.ResponseWriter, r *http.Request) {
+	p, ok := targetPrefix(w, r)
+	if !ok {
+		return
+	}
+	if !a.lists.Admin.Remove(p) {
+		writeJSON(w, http.StatusNotFound, adminError{Error: "not allowlisted"})
+		return
+	}
+	writeJSON(w, http.StatusOK, adminCount{Removed: 1})
+}
+
+// targetPrefix parses target query parameter, answers request on failure
+func targetPrefix(w http.ResponseWriter, r *http.Request) (netip.Prefix, bool) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: "missing target"})
+		return netip.Prefix{}, false
+	}
+	p, err := ParsePrefix(target)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+		return netip.Prefix{}, false
+	}
+	return p, true
+}
+
+func newAdminEntry(e BlockEntry, now time.Time) AdminEntry {
+	entry := AdminEntry{BlockEntry: e, Banned: now.Before(e.Until)}
+	if entry.Banned {
+		entry.Remaining = e.Until.Sub(now).Seconds()
+	}
+	return entry
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("writing response", "val", err.Error())
+	}
+}
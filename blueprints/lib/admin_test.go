@@ -0,0 +1,196 @@
+package lib_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+const adminToken = "secret"
+
+func adminDo(t *testing.T, h http.Handler, method, target, body, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminAuth(t *testing.T) {
+	blocker := lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{}, 0)
+	h := lib.NewAdmin(blocker, lib.NewAccessLists(), lib.NewRouteTable(), adminToken)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		status int
+	}{
+		{"no token", http.MethodGet, "/admin/ips", "", http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "/admin/ips", "nope", http.StatusUnauthorized},
+		{"list", http.MethodGet, "/admin/ips", adminToken, http.StatusOK},
+		{"mutation by get", http.MethodGet, "/admin/bans?target=10.0.0.1", adminToken, http.StatusMethodNotAllowed},
+		{"unauthorized mutation", http.MethodDelete, "/admin/ips", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := adminDo(t, h, tt.method, tt.target, "", tt.token); rec.Code != tt.status {
+				t.Errorf("got %d, expected %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestAdminBans(t *testing.T) {
+	blocker := lib.NewIPBlocker(5, time.Hour, lib.JailPolicy{}, 0)
+	h := lib.NewAdmin(blocker, lib.NewAccessLists(), lib.NewRouteTable(), adminToken)
+
+	rec := adminDo(t, h, http.MethodPost, "/admin/bans",
+		`{"ip":"203.0.113.10","reason":"abuse","duration":"30m"}`, adminToken)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("ban returned %d: %s", rec.Code, rec.Body)
+	}
+	if d := blocker.BannedFor("203.0.113.10"); d <= 29*time.Minute || d > 30*time.Minute {
+		t.Errorf("ban lasts %v", d)
+	}
+	blocker.Ban("203.0.113.11", 0, "test")
+	blocker.Ban("198.51.100.1", 0, "test")
+	blocker.NotifyFailure("198.51.100.2", 1)
+
+	var list []lib.AdminEntry
+	rec = adminDo(t, h, http.MethodGet, "/admin/ips?banned=true", "", adminToken)
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[0].IP != "198.51.100.1" || list[1].Reason != "admin: abuse" {
+		t.Errorf("unexpected banned list %+v", list)
+	}
+
+	rec = adminDo(t, h, http.MethodDelete, "/admin/bans?target=203.0.113.0/24", "", adminToken)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"removed":2`) {
+		t.Errorf("cidr unban returned %d: %s", rec.Code, rec.Body)
+	}
+	if blocker.CheckBlocked("203.0.113.10") || !blocker.CheckBlocked("198.51.100.1") {
+		t.Error("cidr unban applied to wrong ips")
+	}
+
+	if rec = adminDo(t, h, http.MethodGet, "/admin/ips/198.51.100.2", "", adminToken); rec.Code != http.StatusOK {
+		t.Errorf("tracked ip lookup returned %d", rec.Code)
+	}
+	rec = adminDo(t, h, http.MethodPost, "/admin/bans", `{"ip":"nope"}`, adminToken)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid ban returned %d", rec.Code)
+	}
+}
+
+func TestAdminAllowlist(t *testing.T) {
+	vars := &lib.EnvVars{BucketLimit: 1, BucketRate: 1}
+	blocker := lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{}, 0)
+	lists := lib.NewAccessLists()
+	allow := lists.Admin
+	h := lib.NewAdmin(blocker, lists, lib.NewRouteTable(), adminToken)
+
+	routes := lib.NewRouteTable()
+	backend := echoServer("backend")
+	defer backend.Close()
+	targets, _ := lib.ParseTargets(backend.URL)
+	_ = routes.Add("example.com", &lib.Route{Prefix: "/", Pool: lib.NewPool("", targets)})
+	proxy := lib.InitServer(blocker, lib.NewBucket(vars), vars, testMetrics(), routes, nil, lists).Handler
+
+	get := func() int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	blocker.Ban("192.0.2.1", 0, "test")
+	if code := get(); code != http.StatusForbidden {
+		t.Fatalf("banned ip got %d", code)
+	}
+
+	rec := adminDo(t, h, http.MethodPost, "/admin/allow", `{"cidr":"192.0.2.0/24"}`, adminToken)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("allow returned %d", rec.Code)
+	}
+	// allowlisted clients bypass bans and rate limits
+	for range 3 {
+		if code := get(); code != http.StatusOK {
+			t.Fatalf("allowlisted ip got %d", code)
+		}
+	}
+	if !allow.Contains(netip.MustParseAddr("::ffff:192.0.2.7")) {
+		t.Error("mapped address not matched")
+	}
+
+	rec = adminDo(t, h, http.MethodDelete, "/admin/allow?target=192.0.2.0/24", "", adminToken)
+	if rec.Code != http.StatusOK || allow.Len() != 0 {
+		t.Errorf("allow removal returned %d", rec.Code)
+	}
+	if code := get(); code != http.StatusForbidden {
+		t.Errorf("ip still allowed after removal, got %d", code)
+	}
+}
+
+func TestAdminClient(t *testing.T) {
+	blocker := lib.NewIPBlocker(3, time.Hour, lib.JailPolicy{}, 0)
+	lists := lib.NewAccessLists()
+	lists.Admin.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	routes := lib.NewRouteTable()
+	targets, _ := lib.ParseTargets("a:80,b:80")
+	_ = routes.Add("example.com", &lib.Route{Prefix: "/", Pool: lib.NewPool(lib.LBLeastConn, targets)})
+	srv := httptest.NewServer(lib.NewAdmin(blocker, lists, routes, adminToken))
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := lib.NewAdminClient(srv.URL, adminToken)
+
+	entry, err := c.Ban(ctx, "203.0.113.20", "scraper", time.Hour)
+	if err != nil || !entry.Banned || entry.Reason != "admin: scraper" {
+		t.Fatalf("ban: %+v %v", entry, err)
+	}
+	blocker.NotifyFailure("203.0.113.21", 1)
+	if list, err := c.List(ctx, true); err != nil || len(list) != 1 {
+		t.Errorf("list banned: %+v %v", list, err)
+	}
+
+	tests := []struct {
+		ip      string
+		verdict string
+	}{
+		{"203.0.113.20", lib.VerdictBanned},
+		{"203.0.113.21", lib.VerdictTracked},
+		{"203.0.113.22", lib.VerdictClean},
+		{"10.1.2.3", lib.VerdictAllowed},
+	}
+	for _, tt := range tests {
+		ex, err := c.Explain(ctx, tt.ip)
+		if err != nil || ex.Verdict != tt.verdict {
+			t.Errorf("explain %s: %+v %v", tt.ip, ex, err)
+		}
+	}
+
+	if n, err := c.Unban(ctx, "203.0.113.20"); err != nil || n != 1 {
+		t.Errorf("unban: %d %v", n, err)
+	}
+	list, err := c.Routes(ctx)
+	if err != nil || len(list) != 1 || len(list[0].Targets) != 2 || list[0].Policy != lib.LBLeastConn {
+		t.Errorf("routes: %+v %v", list, err)
+	}
+
+	if _, err = lib.NewAdminClient(srv.URL, "nope").List(ctx, false); !errors.Is(err, lib.ErrAdmin) {
+		t.Errorf("unauthorized request returned %v", err)
+	}
+}
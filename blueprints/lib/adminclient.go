@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrAdmin = errors.New("admin api request failed")
+
+// AdminClient talks to admin api of running ratelimiter
+type AdminClient struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+func NewAdminClient(base, token string) *AdminClient {
+	return &AdminClient{
+		base:   strings.TrimSuffix(base, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c *AdminClient) List(ctx context.Context, bannedOnly bool) ([]AdminEntry, error) {
+	path := "/admin/ips"
+	if bannedOnly {
+		path += "?banned=true"
+	}
+	var list []AdminEntry
+	return list, c.do(ctx, http.MethodGet, path, nil, &list)
+}
+
+// Ban bans ip for d, zero d escalates by jail policy of the server
+func (c *AdminClient) Ban(ctx context.Context, ip, reason string, d time.Duration) (*AdminEntry, error) {
+	req := AdminBan{IP: ip, Reason: reason}
+	if d > 0 {
+		req.Duration = d.String()
+	}
+	var entry AdminEntry
+	return &entry, c.do(ctx, http.MethodPost, "/admin/bans", req, &entry)
+}
+
+// Unban removes records of ip or cidr, returns number of removed records
+func (c *AdminClient) Unban(ctx context.Context, target string) (int, error) {
+	var res adminCount
+	err := c.do(ctx, http.MethodDelete, "/admin/bans?target="+url.QueryEscape(target), nil, &res)
+	return res.Removed, err
+}
+
+func (c *AdminClient) Explain(ctx context.Context, ip string) (*AdminExplain, error) {
+	var ex AdminExplain
+	return &ex, c.do(ctx, http.MethodGet, "/admin/explain/"+url.PathEscape(ip), nil, &ex)
+}
+
+func (c *AdminClient) Routes(ctx context.Context) ([]AdminRoute, error) {
+	var list []AdminRoute
+	return list, c.do(ctx, http.MethodGet, "/admin/routes", nil, &list)
+}
+
+func (c *AdminClient) do(ctx context.Context, method, path string, body, out any) error {
+	var rd io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var e adminError
+		if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == "" {
+			e.Error = resp.Status
+		}
+		return errors.Join(ErrAdmin, errors.New(e.Error))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
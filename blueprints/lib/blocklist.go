@@ -0,0 +1,205 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Blocklist export formats
+const (
+	BlocklistText     = "txt"
+	BlocklistNft      = "nft"
+	BlocklistIPSet    = "ipset"
+	BlocklistMikroTik = "mikrotik"
+	BlocklistJSON     = "json"
+
+	blocklistName = "ratelimiter"
+)
+
+type blocklistEntry struct {
+	IP     string    `json:"ip"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason,omitempty"`
+
+	prefix netip.Prefix
+}
+
+// ttl returns remaining ban in whole seconds, at least one
+func (e *blocklistEntry) ttl(now time.Time) int64 {
+	return max(int64(e.Until.Sub(now).Seconds()), 1)
+}
+
+// NewBlocklistHandler serves active bans of filter as GET /blocklist/{format} for edge firewalls,
+// ETag changes only when set of bans does, so polling clients get 304 with If-None-Match. Bans
+// overlapping allowlists are left out.
+func NewBlocklistHandler(filter ClientFilter, lists *AccessLists) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /blocklist/{format}", func(w http.ResponseWriter, r *http.Request) {
+		format := r.PathValue("format")
+		render, ok := blocklistRenderers[format]
+		if !ok {
+			http.Error(w, "unknown format, use one of txt, nft, ipset, mikrotik, json", http.StatusNotFound)
+			return
+		}
+
+		now := time.Now()
+		entries := exportableBans(filter, lists, now)
+		etag := blocklistETag(format, entries)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		var buf bytes.Buffer
+		contentType := render(&buf, entries, now)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		_, _ = w.Write(buf.Bytes())
+	})
+	return mux
+}
+
+type blocklistRenderer func(buf *bytes.Buffer, entries []blocklistEntry, now time.Time) string
+
+var blocklistRenderers = map[string]blocklistRenderer{
+	BlocklistText:     renderText,
+	BlocklistNft:      renderNft,
+	BlocklistIPSet:    renderIPSet,
+	BlocklistMikroTik: renderMikroTik,
+	BlocklistJSON:     renderJSON,
+}
+
+// exportableBans returns banned ips and client prefixes sorted by address, bans overlapping
+// allowlists are skipped, exporting them would block allowed clients at the edge
+func exportableBans(filter ClientFilter, lists *AccessLists, now time.Time) []blocklistEntry {
+	var entries []blocklistEntry
+	for _, e := range filter.List() {
+		// entries are addresses or client prefixes
+		p, err := ParsePrefix(e.IP)
+		if err != nil || !now.Before(e.Until) {
+			continue
+		}
+		if name, _, ok := lists.AllowedPrefix(p); ok {
+			slog.Debug("allowlisted ban not exported", lIP, e.IP, "list", name)
+			continue
+		}
+		entries = append(entries, blocklistEntry{IP: e.IP, Until: e.Until, Reason: e.Reason, prefix: p})
+	}
+	slices.SortFunc(entries, func(a, b blocklistEntry) int {
+		if c := a.prefix.Addr().Compare(b.prefix.Addr()); c != 0 {
+			return c
+		}
+		return a.prefix.Bits() - b.prefix.Bits()
+	})
+	return entries
+}
+
+// blocklistETag is weak, rendered ttls change every second while bans stay the same
+func blocklistETag(format string, entries []blocklistEntry) string {
+	h := sha256.New()
+	h.Write([]byte(format))
+	for _, e := range entries {
+		fmt.Fprintf(h, "\n%s %d", e.IP, e.Until.Unix())
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+func etagMatch(header, etag string) bool {
+	for c := range strings.SplitSeq(header, ",") {
+		c = strings.TrimSpace(c)
+		if c == "*" || strings.TrimPrefix(c, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+func renderText(buf *bytes.Buffer, entries []blocklistEntry, _ time.Time) string {
+	for _, e := range entries {
+		buf.WriteString(e.IP)
+		buf.WriteByte('\n')
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// renderNft writes script for nft -f, sets are flushed and refilled on each load
+func renderNft(buf *bytes.Buffer, entries []blocklistEntry, now time.Time) string {
+	fmt.Fprintf(buf, "add table inet %s\n", blocklistName)
+	for _, fam := range []struct {
+		set, typ string
+		v4       bool
+	}{{"banned_v4", "ipv4_addr", true}, {"banned_v6", "ipv6_addr", false}} {
+		fmt.Fprintf(buf, "add set inet %s %s { type %s; flags interval, timeout; }\n", blocklistName, fam.set, fam.typ)
+		fmt.Fprintf(buf, "flush set inet %s %s\n", blocklistName, fam.set)
+		for _, e := range entries {
+			if e.prefix.Addr().Is4() == fam.v4 {
+				fmt.Fprintf(buf, "add element inet %s %s { %s timeout %ds }\n", blocklistName, fam.set, e.IP, e.ttl(now))
+			}
+		}
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// renderIPSet writes file for ipset restore
+func renderIPSet(buf *bytes.Buffer, entries []blocklistEntry, now time.Time) string {
+	for _, fam := range []struct {
+		set, family string
+		v4          bool
+	}{{blocklistName + "_v4", "inet", true}, {blocklistName + "_v6", "inet6", false}} {
+		fmt.Fprintf(buf, "create %s hash:net family %s timeout 0 -exist\n", fam.set, fam.family)
+		fmt.Fprintf(buf, "flush %s\n", fam.set)
+		for _, e := range entries {
+			if e.prefix.Addr().Is4() == fam.v4 {
+				fmt.Fprintf(buf, "add %s %s timeout %d -exist\n", fam.set, e.IP, e.ttl(now))
+			}
+		}
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// renderMikroTik writes RouterOS script replacing address list entries
+func renderMikroTik(buf *bytes.Buffer, entries []blocklistEntry, now time.Time) string {
+	for _, fam := range []struct {
+		menu string
+		v4   bool
+	}{{"/ip firewall address-list", true}, {"/ipv6 firewall address-list", false}} {
+		fmt.Fprintf(buf, "%s remove [find list=%s]\n", fam.menu, blocklistName)
+		for _, e := range entries {
+			if e.prefix.Addr().Is4() == fam.v4 {
+				fmt.Fprintf(buf, "%s add list=%s address=%s timeout=%ds comment=%q\n",
+					fam.menu, blocklistName, e.IP, e.ttl(now), mikroTikComment(e.Reason))
+			}
+		}
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// mikroTikComment keeps comment safe to embed in quoted RouterOS string
+func mikroTikComment(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '"' || r == '\\' || r == '$' || r < ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func renderJSON(buf *bytes.Buffer, entries []blocklistEntry, _ time.Time) string {
+	if entries == nil {
+		entries = []blocklistEntry{}
+	}
+	_ = json.NewEncoder(buf).Encode(entries)
+	return "application/json"
+}
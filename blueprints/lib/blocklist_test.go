@@ -0,0 +1,112 @@
+package lib_test
+
+import (
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlocklistFormats(t *testing.T) {
+	blocker := lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{}, 0)
+	blocker.Ban("203.0.113.9", time.Hour, `scanner "x"`)
+	blocker.Ban("2001:db8::7", time.Hour, "test")
+	blocker.NotifyFailure("198.51.100.1", 1)
+	h := lib.NewBlocklistHandler(blocker, nil)
+
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{lib.BlocklistText, []string{"203.0.113.9\n2001:db8::7\n"}},
+		{lib.BlocklistNft, []string{
+			"add set inet ratelimiter banned_v4 { type ipv4_addr; flags interval, timeout; }",
+			"flush set inet ratelimiter banned_v6",
+			"add element inet ratelimiter banned_v4 { 203.0.113.9 timeout 3599s }",
+			"add element inet ratelimiter banned_v6 { 2001:db8::7 timeout 3599s }",
+		}},
+		{lib.BlocklistIPSet, []string{
+			"create ratelimiter_v4 hash:net family inet timeout 0 -exist",
+			"add ratelimiter_v4 203.0.113.9 timeout 3599 -exist",
+			"add ratelimiter_v6 2001:db8::7 timeout 3599 -exist",
+		}},
+		{lib.BlocklistMikroTik, []string{
+			"/ip firewall address-list remove [find list=ratelimiter]",
+			`/ip firewall address-list add list=ratelimiter address=203.0.113.9 timeout=3599s comment="scanner _x_"`,
+			"/ipv6 firewall address-list add list=ratelimiter address=2001:db8::7",
+		}},
+		{lib.BlocklistJSON, []string{`"ip":"203.0.113.9"`, `"reason":"test"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/blocklist/"+tt.format, nil))
+			body := rec.Body.String()
+			if rec.Code != http.StatusOK || strings.Contains(body, "198.51.100.1") {
+				t.Fatalf("got %d: %s", rec.Code, body)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(body, w) {
+					t.Errorf("missing %q in\n%s", w, body)
+				}
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/blocklist/pf", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown format got %d", rec.Code)
+	}
+}
+
+func TestBlocklistETag(t *testing.T) {
+	blocker := lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{}, 0)
+	blocker.Ban("203.0.113.9", time.Hour, "test")
+	h := lib.NewBlocklistHandler(blocker, nil)
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/blocklist/nft", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	etag := get("").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no etag")
+	}
+	if rec := get(etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("unchanged list got %d", rec.Code)
+	}
+
+	blocker.Ban("203.0.113.10", time.Hour, "test")
+	rec := get(etag)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("changed list got %d with etag %s", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestBlocklistAllowlisted(t *testing.T) {
+	blocker := lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{}, 0)
+	blocker.Ban("203.0.113.9", time.Hour, "test")
+	blocker.Ban("2001:db8:1::/64", time.Hour, "test")
+	blocker.Ban("198.51.100.1", time.Hour, "test")
+	lists := lib.NewAccessLists()
+	lists.Admin.Add(netip.MustParsePrefix("203.0.113.0/24"))
+	// allowlisted client within banned client prefix
+	lists.Admin.Add(netip.MustParsePrefix("2001:db8:1::5/128"))
+	h := lib.NewBlocklistHandler(blocker, lists)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/blocklist/txt", nil))
+	if body := rec.Body.String(); body != "198.51.100.1\n" {
+		t.Errorf("exported %q", body)
+	}
+}
@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ReasonBanned      = "ip-banned"
+	ReasonRateLimited = "rate-limited"
+	ReasonNotRouted   = "not-routed"
+)
+
+var blockPage = template.Must(template.New("block").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Status}} {{.Title}}</title></head>
+<body><h1>{{.Title}}</h1><p>{{.Message}}</p>{{if .RetryAfter}}<p>Try again in {{.RetryAfter}} seconds.</p>{{end}}</body>
+</html>
+`))
+
+type BlockResponse struct {
+	Status  int
+	Message string
+}
+
+type blockBody struct {
+	Error      string `json:"error"`
+	Message    string `json:"message"`
+	RetryAfter int64  `json:"retry_after,omitempty"`
+	Status     int    `json:"-"`
+	Title      string `json:"-"`
+}
+
+// BlockResponses maps block reason to response written to the client
+type BlockResponses map[string]BlockResponse
+
+func NewBlockResponses(vars *EnvVars) BlockResponses {
+	return BlockResponses{
+		ReasonBanned:      {Status: vars.BannedStatus, Message: vars.BannedMessage},
+		ReasonRateLimited: {Status: vars.RateLimitStatus, Message: vars.RateLimitMessage},
+		ReasonNotRouted:   {Status: vars.NotRoutedStatus, Message: vars.NotRoutedMessage},
+	}
+}
+
+// Write writes response for reason with Retry-After and body format negotiated by Accept header,
+// returns written status
+func (b BlockResponses) Write(w http.ResponseWriter, r *http.Request, reason string, retry time.Duration) int {
+	resp, ok := b[reason]
+	if !ok || resp.Status == 0 {
+		resp.Status = http.StatusForbidden
+	}
+
+	body := blockBody{
+		Error:   reason,
+		Message: resp.Message,
+		Status:  resp.Status,
+		Title:   http.StatusText(resp.Status),
+	}
+	if retry > 0 {
+		body.RetryAfter = int64(math.Ceil(retry.Seconds()))
+		w.Header().Set("Retry-After", strconv.FormatInt(body.RetryAfter, 10))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	var err error
+	if prefersHTML(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(resp.Status)
+		err = blockPage.Execute(w, body)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.Status)
+		err = json.NewEncoder(w).Encode(body)
+	}
+	if err != nil {
+		slog.Warn("writing block response", "val", err.Error())
+	}
+	return resp.Status
+}
+
+// prefersHTML reports if text/html is listed in Accept before application/json, json is the default
+func prefersHTML(accept string) bool {
+	html := strings.Index(accept, "text/html")
+	if html < 0 {
+		return false
+	}
+	js := strings.Index(accept, "application/json")
+	return js < 0 || html < js
+}
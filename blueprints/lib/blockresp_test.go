@@ -0,0 +1,59 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlockResponses(t *testing.T) {
+	vars := &lib.EnvVars{
+		BucketLimit: 1, BucketRate: 1, BucketIdle: time.Minute,
+		BannedStatus: http.StatusForbidden, RateLimitStatus: http.StatusTooManyRequests,
+		NotRoutedStatus: http.StatusNotFound,
+	}
+	blocker := lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{}, 0)
+	blocker.NotifyFailure("192.0.2.1", 2)
+	handler := lib.InitServer(blocker, lib.NewBucket(vars), vars, testMetrics(), lib.NewRouteTable(), nil, nil).Handler
+
+	serve := func(remote, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://unknown.example.top/", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("192.0.2.1:1234", "text/html,application/xhtml+xml,*/*")
+	if rec.Code != http.StatusForbidden || rec.Header().Get("Retry-After") != "3600" {
+		t.Errorf("banned: got %d retry %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("banned: browser got %q", rec.Header().Get("Content-Type"))
+	}
+
+	rec = serve("192.0.2.2:1234", "application/json")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("not routed: got %d", rec.Code)
+	}
+
+	rec = serve("192.0.2.2:1234", "application/json")
+	var body struct {
+		Error      string `json:"error"`
+		RetryAfter int    `json:"retry_after"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusTooManyRequests || body.Error != lib.ReasonRateLimited || body.RetryAfter < 1 {
+		t.Errorf("rate limited: got %d %+v", rec.Code, body)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("rate limited: missing Retry-After")
+	}
+}
@@ -0,0 +1,298 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+var CiliumPolicyGVR = schema.GroupVersionResource{
+	Group:    "cilium.io",
+	Version:  "v2",
+	Resource: "ciliumclusterwidenetworkpolicies",
+}
+
+const (
+	ciliumManagedBy = "ratelimiter"
+	ciliumLease     = 15 * time.Second
+)
+
+// ciliumNeverDeny are node, pod and gateway ranges, denying them would cut cluster off itself
+var ciliumNeverDeny = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("::1/128"),
+}
+
+// CiliumExporter mirrors active bans into ingressDeny fromCIDR rule of a
+// CiliumClusterwideNetworkPolicy, so cilium drops banned clients before they reach the proxy.
+// Policy is written at most once per debounce interval, holds at most maxCIDRs longest bans and
+// is deleted once no ban is active. Bans overlapping allowlists, trusted proxies or private ranges
+// are not exported, cilium would drop allowed clients or cluster's own traffic too. With lock set
+// only the replica holding it writes the policy. Policy disables default deny, which needs cilium 1.15+.
+type CiliumExporter struct {
+	client   dynamic.ResourceInterface
+	filter   ClientFilter
+	lists    *AccessLists
+	trusted  TrustedProxies
+	name     string
+	selector map[string]string
+	maxCIDRs int
+	debounce time.Duration
+	lock     resourcelock.Interface
+
+	applied []string
+}
+
+func NewCiliumExporter(
+	client dynamic.Interface, filter ClientFilter, lists *AccessLists, vars *EnvVars,
+) (*CiliumExporter, error) {
+	// empty selector would apply the policy to every endpoint of the cluster
+	if strings.TrimSpace(vars.CiliumSelector) == "" {
+		return nil, errors.New("CILIUM_SELECTOR is not set")
+	}
+	selector, err := labels.ConvertSelectorToLabelsMap(vars.CiliumSelector)
+	if err != nil {
+		return nil, err
+	}
+	return &CiliumExporter{
+		client:   client.Resource(CiliumPolicyGVR),
+		filter:   filter,
+		lists:    lists,
+		trusted:  vars.TrustedProxies,
+		name:     vars.CiliumPolicy,
+		selector: selector,
+		maxCIDRs: vars.CiliumMaxCIDRs,
+		debounce: vars.CiliumDebounce,
+	}, nil
+}
+
+// Run syncs policy every debounce interval until ctx is done, with lock only while holding it
+func (c *CiliumExporter) Run(ctx context.Context) {
+	if c.debounce <= 0 {
+		return
+	}
+	if c.lock == nil {
+		c.run(ctx)
+		return
+	}
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            c.lock,
+			LeaseDuration:   ciliumLease,
+			RenewDeadline:   ciliumLease * 2 / 3,
+			RetryPeriod:     ciliumLease / 5,
+			ReleaseOnCancel: true,
+			Name:            c.name,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					slog.Info("exporting bans to cilium", "policy", c.name)
+					// policy may have been written by previous holder
+					c.applied = nil
+					c.run(ctx)
+				},
+				OnStoppedLeading: func() {},
+			},
+		})
+	}
+}
+
+func (c *CiliumExporter) run(ctx context.Context) {
+	t := time.NewTicker(c.debounce)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := c.Sync(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("syncing cilium policy", "val", err.Error(), "policy", c.name)
+			}
+		}
+	}
+}
+
+// Sync writes current bans to the policy if they changed since last sync
+func (c *CiliumExporter) Sync(ctx context.Context) error {
+	cidrs := c.bannedCIDRs()
+	if c.applied != nil && slices.Equal(cidrs, c.applied) {
+		return nil
+	}
+
+	var err error
+	if len(cidrs) == 0 {
+		err = c.client.Delete(ctx, c.name, metav1.DeleteOptions{})
+		if apierrors.IsNotFound(err) {
+			err = nil
+		}
+	} else {
+		err = c.apply(ctx, cidrs)
+	}
+	if err != nil {
+		return err
+	}
+
+	slog.Info("cilium policy synced", "policy", c.name, "val", len(cidrs))
+	c.applied = cidrs
+	return nil
+}
+
+// bannedCIDRs returns sorted prefixes of active bans not overlapping allowlists, trusted proxies
+// or private ranges, longest bans are kept when over cap
+func (c *CiliumExporter) bannedCIDRs() []string {
+	entries := slices.DeleteFunc(exportableBans(c.filter, c.lists, time.Now()), func(e blocklistEntry) bool {
+		if overlapsAny(e.prefix, c.trusted) || overlapsAny(e.prefix, ciliumNeverDeny) {
+			slog.Debug("private or trusted ban not exported to cilium", lIP, e.IP)
+			return true
+		}
+		return false
+	})
+	if c.maxCIDRs > 0 && len(entries) > c.maxCIDRs {
+		slog.Warn("cilium policy over cap, exporting longest bans only", "val", len(entries), "cap", c.maxCIDRs)
+		slices.SortFunc(entries, func(a, b blocklistEntry) int { return b.Until.Compare(a.Until) })
+		entries = entries[:c.maxCIDRs]
+	}
+
+	cidrs := make([]string, 0, len(entries))
+	for _, e := range entries {
+		// client prefix keys are exported as they are, addresses as host prefixes
+		cidrs = append(cidrs, e.prefix.String())
+	}
+	slices.Sort(cidrs)
+	return slices.Compact(cidrs)
+}
+
+func (c *CiliumExporter) apply(ctx context.Context, cidrs []string) error {
+	spec := c.spec(cidrs)
+
+	obj, err := c.client.Get(ctx, c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		obj = &unstructured.Unstructured{}
+		obj.SetAPIVersion(CiliumPolicyGVR.GroupVersion().String())
+		obj.SetKind("CiliumClusterwideNetworkPolicy")
+		obj.SetName(c.name)
+		obj.SetLabels(map[string]string{"app.kubernetes.io/managed-by": ciliumManagedBy})
+		obj.Object["spec"] = spec
+		_, err = c.client.Create(ctx, obj, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if obj.GetLabels()["app.kubernetes.io/managed-by"] != ciliumManagedBy {
+		return errors.New("policy " + c.name + " is not managed by ratelimiter")
+	}
+	obj.Object["spec"] = spec
+	_, err = c.client.Update(ctx, obj, metav1.UpdateOptions{})
+	return err
+}
+
+func (c *CiliumExporter) spec(cidrs []string) map[string]any {
+	matchLabels := make(map[string]any, len(c.selector))
+	for k, v := range c.selector {
+		matchLabels[k] = v
+	}
+	from := make([]any, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		from = append(from, cidr)
+	}
+
+	return map[string]any{
+		"endpointSelector":  map[string]any{"matchLabels": matchLabels},
+		"enableDefaultDeny": map[string]any{"ingress": false, "egress": false},
+		"ingressDeny":       []any{map[string]any{"fromCIDR": from}},
+	}
+}
+
+func initDynamicClient() (dynamic.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.New("cluster config is not initialized: " + err.Error())
+	}
+
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, errors.New("failed to create dynamic client: " + err.Error())
+	}
+	return client, nil
+}
+
+// NewCiliumExporterFromEnv creates exporter with in cluster client, false means CILIUM_POLICY is
+// empty and export is disabled. Replicas elect the writer by lease named as the policy in namespace
+// of the pod.
+func NewCiliumExporterFromEnv(
+	filter ClientFilter, lists *AccessLists, vars *EnvVars,
+) (*CiliumExporter, bool, error) {
+	if vars.CiliumPolicy == "" {
+		return nil, false, nil
+	}
+	client, err := initDynamicClient()
+	if err != nil {
+		return nil, false, err
+	}
+	exp, err := NewCiliumExporter(client, filter, lists, vars)
+	if err != nil {
+		return nil, false, err
+	}
+	if exp.lock, err = initLeaseLock(vars.Namespace, vars.CiliumPolicy); err != nil {
+		return nil, false, err
+	}
+	return exp, true, nil
+}
+
+func initLeaseLock(namespace, name string) (resourcelock.Interface, error) {
+	namespace, err := podNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	// pod name is unique among replicas
+	id, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.New("cluster config is not initialized: " + err.Error())
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.New("failed to create clientset: " + err.Error())
+	}
+	return &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: id},
+	}, nil
+}
+
+// overlapsAny reports if p overlaps any of prefixes
+func overlapsAny(p netip.Prefix, prefixes []netip.Prefix) bool {
+	for _, q := range prefixes {
+		if p.Overlaps(q) {
+			return true
+		}
+	}
+	return false
+}
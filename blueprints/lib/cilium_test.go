@@ -0,0 +1,103 @@
+package lib_test
+
+import (
+	"context"
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestCiliumExporter(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{lib.CiliumPolicyGVR: "CiliumClusterwideNetworkPolicyList"})
+	policies := client.Resource(lib.CiliumPolicyGVR)
+	ctx := context.Background()
+
+	blocker := lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{}, 0)
+	vars := &lib.EnvVars{
+		CiliumPolicy:   "ratelimiter-bans",
+		CiliumSelector: "app=ingress",
+		CiliumMaxCIDRs: 2,
+		TrustedProxies: lib.TrustedProxies{netip.MustParsePrefix("192.0.2.0/24")},
+	}
+	lists := lib.NewAccessLists()
+	if _, err := lib.NewCiliumExporter(client, blocker, lists, &lib.EnvVars{CiliumPolicy: "x"}); err == nil {
+		t.Error("policy selecting every endpoint accepted")
+	}
+	exp, err := lib.NewCiliumExporter(client, blocker, lists, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromCIDR := func() []string {
+		t.Helper()
+		obj, err := policies.Get(ctx, vars.CiliumPolicy, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules, _, _ := unstructured.NestedSlice(obj.Object, "spec", "ingressDeny")
+		if len(rules) != 1 {
+			t.Fatalf("unexpected ingressDeny %v", rules)
+		}
+		cidrs, _, _ := unstructured.NestedStringSlice(rules[0].(map[string]any), "fromCIDR")
+		return cidrs
+	}
+
+	blocker.Ban("203.0.113.1", time.Hour, "test")
+	blocker.Ban("2001:db8::1", 2*time.Hour, "test")
+	blocker.NotifyFailure("198.51.100.1", 1)
+	if err = exp.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := fromCIDR(); !slices.Equal(got, []string{"2001:db8::1/128", "203.0.113.1/32"}) {
+		t.Errorf("exported %v", got)
+	}
+	obj, _ := policies.Get(ctx, vars.CiliumPolicy, metav1.GetOptions{})
+	sel, _, _ := unstructured.NestedString(obj.Object, "spec", "endpointSelector", "matchLabels", "app")
+	if sel != "ingress" {
+		t.Errorf("endpoint selector %q", sel)
+	}
+
+	// over cap the shortest ban is left out
+	blocker.Ban("203.0.113.2", 3*time.Hour, "test")
+	if err = exp.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := fromCIDR(); !slices.Equal(got, []string{"2001:db8::1/128", "203.0.113.2/32"}) {
+		t.Errorf("capped export %v", got)
+	}
+
+	// allowlisted clients stay reachable, also within banned client prefix, and so do cluster
+	// nodes and trusted proxies
+	lists.Admin.Add(netip.MustParsePrefix("203.0.113.0/24"))
+	lists.Admin.Add(netip.MustParsePrefix("2001:db8:1::5/128"))
+	blocker.Ban("2001:db8:1::/64", 4*time.Hour, "test")
+	blocker.Ban("10.0.0.7", 5*time.Hour, "test")
+	blocker.Ban("fd00::7", 5*time.Hour, "test")
+	blocker.Ban("192.0.2.9", 5*time.Hour, "test")
+	if err = exp.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := fromCIDR(); !slices.Equal(got, []string{"2001:db8::1/128"}) {
+		t.Errorf("allowlisted bans exported %v", got)
+	}
+
+	// no active bans removes policy
+	blocker.Unban(netip.MustParsePrefix("::/0"))
+	blocker.Unban(netip.MustParsePrefix("0.0.0.0/0"))
+	if err = exp.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = policies.Get(ctx, vars.CiliumPolicy, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("policy not removed: %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+type clientBucket struct {
+	b       Bucket
+	lastAcc time.Time
+}
+
+// ClientBuckets keeps a lazily created bucket per client key, with an optional global bucket as outer cap
+type ClientBuckets struct {
+	newBucket func() Bucket
+	global    Bucket
+	idle      time.Duration
+	clock     Clock
+	// fresh is quota of unused bucket, reported for unknown clients
+	fresh Quota
+
+	lastSweep time.Time
+	ac        map[string]*clientBucket
+	mu        sync.Mutex
+}
+
+func NewClientBuckets(newBucket func() Bucket, idle time.Duration, global Bucket, clock Clock) *ClientBuckets {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &ClientBuckets{
+		newBucket: newBucket,
+		global:    global,
+		idle:      idle,
+		clock:     clock,
+		fresh:     newBucket().Quota(""),
+		lastSweep: clock(),
+		ac:        make(map[string]*clientBucket, 3),
+	}
+}
+
+// GetToken takes global token only when client has one and client token only when global cap
+// allows the request, so neither bucket pays for requests rejected by the other
+func (c *ClientBuckets) GetToken(key string) bool {
+	b := c.client(key)
+	if c.global == nil {
+		return b.GetToken(key)
+	}
+	if b.RetryAfter(key) > 0 || !c.global.GetToken(key) {
+		return false
+	}
+	// client may lose the token to concurrent request meanwhile, global one is spent then
+	return b.GetToken(key)
+}
+
+func (c *ClientBuckets) RetryAfter(key string) time.Duration {
+	var retry time.Duration
+	c.mu.Lock()
+	x, ok := c.ac[key]
+	c.mu.Unlock()
+	if ok {
+		retry = x.b.RetryAfter(key)
+	}
+	if c.global != nil {
+		retry = max(retry, c.global.RetryAfter(key))
+	}
+	return retry
+}
+
+// Quota reports client bucket, or global one when it has less remaining
+func (c *ClientBuckets) Quota(key string) Quota {
+	c.mu.Lock()
+	x, ok := c.ac[key]
+	c.mu.Unlock()
+
+	q := c.fresh
+	if ok {
+		q = x.b.Quota(key)
+	}
+	if c.global != nil {
+		q = tighter(q, c.global.Quota(key))
+	}
+	return q
+}
+
+// Take takes tokens like GetToken and reports quota like Quota does
+func (c *ClientBuckets) Take(key string) (bool, Quota) {
+	b := c.client(key)
+	if c.global == nil {
+		return b.Take(key)
+	}
+	if b.RetryAfter(key) > 0 {
+		return false, tighter(b.Quota(key), c.global.Quota(key))
+	}
+	ok, g := c.global.Take(key)
+	if !ok {
+		return false, tighter(b.Quota(key), g)
+	}
+	ok, q := b.Take(key)
+	return ok, tighter(q, g)
+}
+
+// tighter returns quota with less remaining, retry after of both applies
+func tighter(q, g Quota) Quota {
+	retry := max(q.RetryAfter, g.RetryAfter)
+	if g.Remaining < q.Remaining {
+		q = g
+	}
+	q.RetryAfter = retry
+	return q
+}
+
+func (c *ClientBuckets) client(key string) Bucket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock()
+	if c.idle > 0 && now.Sub(c.lastSweep) > c.idle {
+		c.sweep(now)
+	}
+
+	x, ok := c.ac[key]
+	if !ok {
+		x = &clientBucket{b: c.newBucket()}
+		c.ac[key] = x
+	}
+	x.lastAcc = now
+	return x.b
+}
+
+// sweep drops buckets which were not used for idle duration, caller must hold mu
+func (c *ClientBuckets) sweep(now time.Time) {
+	for k, x := range c.ac {
+		if now.Sub(x.lastAcc) > c.idle {
+			delete(c.ac, k)
+		}
+	}
+	c.lastSweep = now
+}
@@ -0,0 +1,98 @@
+package lib_test
+
+import (
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"testing"
+	"time"
+)
+
+// newClientBuckets creates buckets of 2 requests per client refilled at rate, global cap of 3
+// requests refilled each second is optional
+func newClientBuckets(clock *fakeClock, rate lib.Rate, globalCap bool) *lib.ClientBuckets {
+	var global lib.Bucket
+	if globalCap {
+		global = lib.NewGCRA(1, 3, clock.Now)
+	}
+	return lib.NewClientBuckets(func() lib.Bucket {
+		return lib.NewGCRA(rate, 2, clock.Now)
+	}, time.Minute, global, clock.Now)
+}
+
+func TestClientBuckets(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+	b := newClientBuckets(clock, 1, false)
+
+	for _, key := range []string{"203.0.113.1", "203.0.113.2"} {
+		if n := drain(keyed{b, key}); n != 2 {
+			t.Errorf("%s allowed %d requests", key, n)
+		}
+	}
+	if d := b.RetryAfter("203.0.113.1"); d != time.Second {
+		t.Errorf("retry after %v", d)
+	}
+	if q := b.Quota("203.0.113.3"); q.Limit != 2 || q.Remaining != 2 || q.Reset != 0 {
+		t.Errorf("quota of unknown client %+v", q)
+	}
+	clock.Advance(time.Second)
+	if !b.GetToken("203.0.113.1") || b.GetToken("203.0.113.1") {
+		t.Error("client bucket not refilled by one token")
+	}
+}
+
+func TestClientBucketsGlobalCap(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+	// client buckets never refill, so spent client tokens stay visible
+	b := newClientBuckets(clock, 0, true)
+
+	drain(keyed{b, "203.0.113.1"})
+	// client without tokens doesn't spend global ones
+	b.GetToken("203.0.113.1")
+	if !b.GetToken("203.0.113.2") {
+		t.Fatal("global cap exhausted by rejected client")
+	}
+	if b.GetToken("203.0.113.2") || b.GetToken("203.0.113.3") {
+		t.Fatal("global cap not applied")
+	}
+	if q := b.Quota("203.0.113.2"); q.Limit != 3 || q.Remaining != 0 || q.RetryAfter != time.Second {
+		t.Errorf("global quota not reported %+v", q)
+	}
+
+	// requests rejected by global cap didn't spend client tokens
+	clock.Advance(3 * time.Second)
+	if !b.GetToken("203.0.113.2") || b.GetToken("203.0.113.2") {
+		t.Error("client token spent by request over global cap")
+	}
+	if ok, q := b.Take("203.0.113.3"); !ok || q.Limit != 2 || q.Remaining != 1 {
+		t.Errorf("take of client with both tokens got %v %+v", ok, q)
+	}
+}
+
+func TestClientBucketsSweep(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+	// buckets never refill, only forgetting them makes room
+	b := lib.NewClientBuckets(func() lib.Bucket {
+		return lib.NewGCRA(0, 1, clock.Now)
+	}, time.Minute, nil, clock.Now)
+
+	b.GetToken("203.0.113.1")
+	b.GetToken("203.0.113.2")
+	clock.Advance(45 * time.Second)
+	b.GetToken("203.0.113.2")
+	clock.Advance(30 * time.Second)
+
+	// the next request sweeps buckets idle for over a minute
+	if !b.GetToken("203.0.113.1") {
+		t.Error("idle bucket kept")
+	}
+	if b.GetToken("203.0.113.2") {
+		t.Error("recently used bucket dropped")
+	}
+}
+
+// keyed adapts client buckets to drain, which takes tokens of the empty key
+type keyed struct {
+	*lib.ClientBuckets
+	key string
+}
+
+func (k keyed) GetToken(_ string) bool { return k.ClientBuckets.GetToken(k.key) }
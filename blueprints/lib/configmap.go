@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	configMapStateKey = "blocker.json"
+	// configMapMaxState leaves room for metadata within 1MiB limit of ConfigMap
+	configMapMaxState = 900 << 10
+
+	serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// ConfigMapStore keeps state in a ConfigMap, which is created on first save. State over
+// configMapMaxState is trimmed, bans are kept first.
+type ConfigMapStore struct {
+	cm   core.ConfigMapInterface
+	name string
+}
+
+func NewConfigMapStore(cm core.ConfigMapInterface, name string) *ConfigMapStore {
+	return &ConfigMapStore{cm: cm, name: name}
+}
+
+func (c *ConfigMapStore) Save(ctx context.Context, entries []BlockEntry) error {
+	data, err := marshalCapped(entries, configMapMaxState)
+	if err != nil {
+		return err
+	}
+
+	cm, err := c.cm.Get(ctx, c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = c.cm.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: c.name},
+			Data:       map[string]string{configMapStateKey: string(data)},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if cm.Data == nil {
+		cm.Data = make(map[string]string, 1)
+	}
+	cm.Data[configMapStateKey] = string(data)
+	_, err = c.cm.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
+
+func (c *ConfigMapStore) Load(ctx context.Context) ([]BlockEntry, error) {
+	cm, err := c.cm.Get(ctx, c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []BlockEntry
+	data, ok := cm.Data[configMapStateKey]
+	if !ok {
+		return nil, nil
+	}
+	return entries, json.Unmarshal([]byte(data), &entries)
+}
+
+// podNamespace returns n, namespace of pod's service account when n is empty
+func podNamespace(n string) (string, error) {
+	if n != "" {
+		return n, nil
+	}
+	data, err := os.ReadFile(serviceAccountNamespace)
+	if err != nil {
+		return "", errors.New("NAMESPACE is not set and pod namespace is unknown: " + err.Error())
+	}
+	if n = strings.TrimSpace(string(data)); n == "" {
+		return "", errors.New("NAMESPACE is not set and pod namespace is empty")
+	}
+	return n, nil
+}
+
+// initConfigMapClient creates client of ConfigMaps in namespace n, namespace of the pod when empty
+func initConfigMapClient(n string) (core.ConfigMapInterface, error) {
+	n, err := podNamespace(n)
+	if err != nil {
+		return nil, err
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.New("cluster config is not initialized: " + err.Error())
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.New("failed to create clientset: " + err.Error())
+	}
+	return clientset.CoreV1().ConfigMaps(n), nil
+}
@@ -8,21 +8,87 @@ import (
 )
 
 type EnvVars struct {
-	PbKey       string        `env:"PB_API"`
-	PbSecret    string        `env:"PB_SECRET"`
-	Target      url.URL       `env:"FINAL_TARGET" envDefault:"http://immich"`
-	ConfMap     string        `env:"CFMAP_IP" envDefault:"public-ip"`
-	BucketLimit int           `env:"BUCKET_LIMIT" envDefault:"10"`
-	BucketRate  int           `env:"BUCKET_RATE" envDefault:"2"`
-	IPLimit     int           `env:"IP_LIMIT" envDefault:"4"`
-	IPDuration  time.Duration `env:"IP_DURATION" envDefault:"2h"`
-	DNSRecheck  time.Duration `env:"DNS_RECHECK" envDefault:"10m"`
-	Namespace   string        `env:"NAMESPACE"`
+	PbKey       string          `env:"PB_API"`
+	PbSecret    string          `env:"PB_SECRET"`
+	Target      url.URL         `env:"FINAL_TARGET" envDefault:"http://immich"`
+	ConfMap     string          `env:"CFMAP_IP" envDefault:"public-ip"`
+	BucketLimit int             `env:"BUCKET_LIMIT" envDefault:"10"`
+	BucketRate  Rate            `env:"BUCKET_RATE" envDefault:"2/s"`
+	BucketIdle  time.Duration   `env:"BUCKET_IDLE" envDefault:"10m"`
+	GlobalLimit int             `env:"GLOBAL_BUCKET_LIMIT"`
+	GlobalRate  Rate            `env:"GLOBAL_BUCKET_RATE"`
+	IPLimit     int             `env:"IP_LIMIT" envDefault:"4"`
+	IPDuration  time.Duration   `env:"IP_DURATION" envDefault:"2h"`
+	IPJail      []time.Duration `env:"IP_JAIL" envDefault:"10m,1h,24h"`
+	IPJailMem   time.Duration   `env:"IP_JAIL_MEMORY" envDefault:"168h"`
+	IPMaxTrack  int             `env:"IP_MAX_TRACKED" envDefault:"20000"`
+	IPSweep     time.Duration   `env:"IP_SWEEP" envDefault:"1m"`
+	PrefixV4    int             `env:"CLIENT_PREFIX_V4" envDefault:"32"`
+	PrefixV6    int             `env:"CLIENT_PREFIX_V6" envDefault:"64"`
+	DNSRecheck  time.Duration   `env:"DNS_RECHECK" envDefault:"10m"`
+	Namespace   string          `env:"NAMESPACE"`
+
+	LBPolicy       string        `env:"LB_POLICY" envDefault:"roundrobin"`
+	HealthPath     string        `env:"HEALTH_PATH" envDefault:"/"`
+	HealthInterval time.Duration `env:"HEALTH_INTERVAL" envDefault:"10s"`
+	HealthTimeout  time.Duration `env:"HEALTH_TIMEOUT" envDefault:"2s"`
+	HealthFails    int           `env:"HEALTH_FAILS" envDefault:"3"`
+
+	StrikeRules string `env:"STRIKE_RULES" envDefault:"404=0.25;4xx=1;5xx=0"`
+
+	BannedStatus     int    `env:"BANNED_STATUS" envDefault:"403"`
+	BannedMessage    string `env:"BANNED_MESSAGE" envDefault:"Your address is temporarily blocked."`
+	RateLimitStatus  int    `env:"RATELIMIT_STATUS" envDefault:"429"`
+	RateLimitMessage string `env:"RATELIMIT_MESSAGE" envDefault:"Too many requests, slow down."`
+	NotRoutedStatus  int    `env:"NOTROUTED_STATUS" envDefault:"404"`
+	NotRoutedMessage string `env:"NOTROUTED_MESSAGE" envDefault:"Unknown host."`
+
+	Inspect      bool   `env:"INSPECT" envDefault:"true"`
+	InspectRules string `env:"INSPECT_RULES"`
+	MaxTarpits   int    `env:"INSPECT_MAX_TARPITS" envDefault:"100"`
+
+	SharedState    bool          `env:"SHARED_STATE"`
+	StateBackend   string        `env:"STATE_BACKEND" envDefault:"none"`
+	StateInterval  time.Duration `env:"STATE_INTERVAL" envDefault:"5m"`
+	StateFile      string        `env:"STATE_FILE" envDefault:"/data/blocker.json"`
+	StateConfigMap string        `env:"STATE_CONFIGMAP" envDefault:"ratelimiter-state"`
+	StateKey       string        `env:"STATE_KEY" envDefault:"ratelimiter:state"`
+	ValkeyAddr     string        `env:"VALKEY_ADDR" envDefault:"valkey:6379"`
+	ValkeyPassword string        `env:"VALKEY_PASSWORD"`
+	ValkeyDB       int           `env:"VALKEY_DB"`
+	ValkeyProbe    time.Duration `env:"VALKEY_PROBE" envDefault:"5s"`
+
+	AllowLists []string      `env:"ALLOW_LISTS"`
+	DenyLists  []string      `env:"DENY_LISTS"`
+	ListReload time.Duration `env:"LIST_RELOAD" envDefault:"30s"`
+	Feeds      string        `env:"FEEDS"`
+
+	CiliumPolicy   string        `env:"CILIUM_POLICY"`
+	CiliumSelector string        `env:"CILIUM_SELECTOR"`
+	CiliumMaxCIDRs int           `env:"CILIUM_MAX_CIDRS" envDefault:"1000"`
+	CiliumDebounce time.Duration `env:"CILIUM_DEBOUNCE" envDefault:"10s"`
+
+	Notify         string        `env:"NOTIFY"`
+	NotifyBatch    time.Duration `env:"NOTIFY_BATCH" envDefault:"10s"`
+	NotifyInterval time.Duration `env:"NOTIFY_INTERVAL" envDefault:"30s"`
+	NotifyBatchMax int           `env:"NOTIFY_BATCH_MAX" envDefault:"50"`
+	NotifyRetries  int           `env:"NOTIFY_RETRIES" envDefault:"3"`
+	StormThreshold int           `env:"STORM_THRESHOLD" envDefault:"200"`
+	StormWindow    time.Duration `env:"STORM_WINDOW" envDefault:"1m"`
+
+	AdminToken string `env:"ADMIN_TOKEN"`
+	AdminAddr  string `env:"ADMIN_ADDR"`
+
+	ProxyProtocol string `env:"PROXY_PROTOCOL" envDefault:"off"`
+	// TrustedProxies should hold gateway and node CIDRs, empty trusts nobody's forwarding headers
+	TrustedProxies TrustedProxies `env:"TRUSTED_PROXIES"`
 }
 
 type Metrics struct {
-	RequestsTotal *prometheus.CounterVec
-	BlockedTotal  *prometheus.CounterVec
+	RequestsTotal  *prometheus.CounterVec
+	BlockedTotal   *prometheus.CounterVec
+	InspectedTotal *prometheus.CounterVec
+	ListHits       *prometheus.CounterVec
 }
 
 func (m *Metrics) Blocked(reason, ip, host, status string) {
@@ -0,0 +1,234 @@
+package lib
+
+import (
+	"context"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event kinds
+const (
+	EventBan   = "ban"
+	EventUnban = "unban"
+	EventStorm = "storm"
+
+	// stormMaxClients caps distinct clients counted per storm window
+	stormMaxClients = 4096
+)
+
+// Event is change of client state worth notifying about. Bans and unbans carry banned ip or
+// prefix, storms the busiest client and number of rate limited requests within the window.
+type Event struct {
+	Kind   string    `json:"kind"`
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason,omitempty"`
+	Count  int       `json:"count,omitempty"`
+	Time   time.Time `json:"time"`
+	Until  time.Time `json:"until,omitzero"`
+}
+
+// Summary returns one line description of e
+func (e Event) Summary() string {
+	switch e.Kind {
+	case EventBan:
+		return e.IP + " banned until " + e.Until.Format(time.RFC3339) + ": " + e.Reason
+	case EventUnban:
+		s := e.IP + " unbanned"
+		if e.Count > 1 {
+			s += ", " + strconv.Itoa(e.Count) + " records removed"
+		}
+		if e.Reason != "" {
+			s += ": " + e.Reason
+		}
+		return s
+	case EventStorm:
+		return strconv.Itoa(e.Count) + " requests rate limited " + e.Reason + ", busiest client " + e.IP
+	}
+	return e.Kind + " " + e.IP
+}
+
+// EventBus fans events out to notifiers and raises storm event once rate limited requests within
+// a window reach threshold
+type EventBus struct {
+	notifiers      []*Notifier
+	stormThreshold int
+	stormWindow    time.Duration
+
+	limited map[string]int
+	total   int
+	mu      sync.Mutex
+}
+
+// NewEventBus creates bus delivering to notifiers, nil without notifiers, zero threshold disables storms
+func NewEventBus(stormThreshold int, stormWindow time.Duration, notifiers ...*Notifier) *EventBus {
+	if len(notifiers) == 0 {
+		return nil
+	}
+	return &EventBus{
+		notifiers:      notifiers,
+		stormThreshold: stormThreshold,
+		stormWindow:    stormWindow,
+		limited:        make(map[string]int),
+	}
+}
+
+// Publish queues e for all notifiers subscribed to its kind, never blocks
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, n := range b.notifiers {
+		n.enqueue(e)
+	}
+}
+
+// RateLimited counts rate limited request of ip towards storm detection
+func (b *EventBus) RateLimited(ip string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.total++
+	if _, ok := b.limited[ip]; ok || len(b.limited) < stormMaxClients {
+		b.limited[ip]++
+	}
+}
+
+// Run delivers events and checks for storms until ctx is done
+func (b *EventBus) Run(ctx context.Context) {
+	if b == nil {
+		return
+	}
+	for _, n := range b.notifiers {
+		go n.Run(ctx)
+	}
+	if b.stormThreshold <= 0 || b.stormWindow <= 0 {
+		return
+	}
+
+	t := time.NewTicker(b.stormWindow)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			b.checkStorm(time.Now())
+		}
+	}
+}
+
+func (b *EventBus) checkStorm(now time.Time) {
+	b.mu.Lock()
+	total, busiest, most := b.total, "", 0
+	for ip, n := range b.limited {
+		if n > most {
+			busiest, most = ip, n
+		}
+	}
+	b.total = 0
+	clear(b.limited)
+	b.mu.Unlock()
+
+	if total < b.stormThreshold {
+		return
+	}
+	b.Publish(Event{
+		Kind:   EventStorm,
+		IP:     busiest,
+		Reason: "within " + b.stormWindow.String(),
+		Count:  total,
+		Time:   now,
+		Until:  now.Add(b.stormWindow),
+	})
+}
+
+type eventFilter struct {
+	ClientFilter
+	bus *EventBus
+}
+
+// NewEventFilter publishes bans and unbans of filter to bus, filter is returned as is without bus
+func NewEventFilter(f ClientFilter, bus *EventBus) ClientFilter {
+	if bus == nil {
+		return f
+	}
+	return &eventFilter{ClientFilter: f, bus: bus}
+}
+
+// NotifyFailure publishes ban only when this failure started it, not for strikes during ban or on other replicas
+func (f *eventFilter) NotifyFailure(ip string, weight float64) time.Duration {
+	d := f.ClientFilter.NotifyFailure(ip, weight)
+	if d > 0 {
+		now := time.Now()
+		f.bus.Publish(Event{Kind: EventBan, IP: ip, Reason: "strike limit", Time: now, Until: now.Add(d)})
+	}
+	return d
+}
+
+func (f *eventFilter) Ban(ip string, d time.Duration, reason string) {
+	f.ClientFilter.Ban(ip, d, reason)
+	now := time.Now()
+	until := now.Add(f.ClientFilter.BannedFor(ip))
+	f.bus.Publish(Event{Kind: EventBan, IP: ip, Reason: reason, Time: now, Until: until})
+}
+
+// Unban publishes unban of every removed record with active ban, keyed the same as its ban event,
+// so sinks like alertmanager can match them. Records without ban were never announced.
+func (f *eventFilter) Unban(p netip.Prefix) int {
+	now := time.Now()
+	var banned []string
+	for _, e := range f.ClientFilter.List() {
+		if key, err := ParsePrefix(e.IP); err == nil && p.Overlaps(key) && now.Before(e.Until) {
+			banned = append(banned, e.IP)
+		}
+	}
+
+	n := f.ClientFilter.Unban(p)
+	if n == 0 {
+		return 0
+	}
+	for _, ip := range banned {
+		f.bus.Publish(Event{Kind: EventUnban, IP: ip, Reason: "matched " + p.String(), Time: now})
+	}
+	return n
+}
+
+func (f *eventFilter) Reset() {
+	n := f.ClientFilter.Len()
+	f.ClientFilter.Reset()
+	f.bus.Publish(Event{Kind: EventUnban, IP: "all", Reason: "reset", Count: n})
+}
+
+type eventBucket struct {
+	Bucket
+	bus *EventBus
+}
+
+// NewEventBucket counts rejections of bucket towards storms, bucket is returned as is without bus
+// or storm threshold
+func NewEventBucket(b Bucket, bus *EventBus) Bucket {
+	if bus == nil || bus.stormThreshold <= 0 {
+		return b
+	}
+	return &eventBucket{Bucket: b, bus: bus}
+}
+
+func (b *eventBucket) GetToken(key string) bool {
+	if b.Bucket.GetToken(key) {
+		return true
+	}
+	b.bus.RateLimited(key)
+	return false
+}
+
+func (b *eventBucket) Take(key string) (bool, Quota) {
+	ok, q := b.Bucket.Take(key)
+	if !ok {
+		b.bus.RateLimited(key)
+	}
+	return ok, q
+}
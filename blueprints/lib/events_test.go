@@ -0,0 +1,294 @@
+package lib_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type request struct {
+	path   string
+	header http.Header
+	body   string
+}
+
+// standIn records requests, answering with statuses in order and 200 afterwards
+func standIn(statuses ...int) (*httptest.Server, chan request) {
+	reqs := make(chan request, 16)
+	var n atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		reqs <- request{path: r.URL.Path, header: r.Header, body: string(body)}
+		if i := int(n.Add(1)) - 1; i < len(statuses) {
+			w.WriteHeader(statuses[i])
+		}
+	}))
+	return srv, reqs
+}
+
+func receive(t *testing.T, reqs chan request) request {
+	t.Helper()
+	select {
+	case r := <-reqs:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatal("no notification")
+	}
+	return request{}
+}
+
+func TestEventFilter(t *testing.T) {
+	srv, reqs := standIn()
+	defer srv.Close()
+	sink, _ := lib.NewSink(lib.SinkWebhook, srv.URL, "secret")
+	n := lib.NewNotifier(sink, 50*time.Millisecond, 0)
+	bus := lib.NewEventBus(0, 0, n)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Run(ctx)
+
+	filter := lib.NewEventFilter(lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{}, 0), bus)
+	filter.NotifyFailure("203.0.113.1", 1)
+	filter.NotifyFailure("203.0.113.1", 1)
+	// strikes during ban don't repeat the event
+	filter.NotifyFailure("203.0.113.1", 1)
+	filter.Unban(netip.MustParsePrefix("203.0.113.0/24"))
+
+	r := receive(t, reqs)
+	if r.header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("missing token: %v", r.header)
+	}
+	var payload struct{ Events []lib.Event }
+	if err := json.Unmarshal([]byte(r.body), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(payload.Events) != 2 {
+		t.Fatalf("expected ban and unban in one batch, got %+v", payload.Events)
+	}
+	ban, unban := payload.Events[0], payload.Events[1]
+	if ban.Kind != lib.EventBan || ban.IP != "203.0.113.1" || ban.Reason != "strike limit" || ban.Until.IsZero() {
+		t.Errorf("unexpected ban %+v", ban)
+	}
+	if unban.Kind != lib.EventUnban || unban.IP != "203.0.113.1" || unban.Reason != "matched 203.0.113.0/24" {
+		t.Errorf("unexpected unban %+v", unban)
+	}
+}
+
+// TestUnbanResolvesAlert checks unban of a wider prefix resolves alert of each banned client prefix
+func TestUnbanResolvesAlert(t *testing.T) {
+	srv, reqs := standIn()
+	defer srv.Close()
+	sink, _ := lib.NewSink(lib.SinkAlertmanager, srv.URL, "")
+	bus := lib.NewEventBus(0, 0, lib.NewNotifier(sink, 50*time.Millisecond, 0))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Run(ctx)
+
+	blocker := lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{}, 0)
+	filter := lib.NewPrefixFilter(lib.NewEventFilter(blocker, bus), lib.ClientPrefix{V4: 32, V6: 64})
+	filter.Ban("2001:db8:0:1::7", time.Hour, "manual")
+	filter.NotifyFailure("2001:db8:0:2::7", 2)
+	// strikes only, never announced
+	blocker.NotifyFailure("2001:db8:0:3::", 0.5)
+	filter.Unban(netip.MustParsePrefix("2001:db8::/48"))
+
+	type alert struct {
+		Labels map[string]string
+		EndsAt time.Time
+	}
+	var alerts []alert
+	for len(alerts) < 4 {
+		var batch []alert
+		if err := json.Unmarshal([]byte(receive(t, reqs).body), &batch); err != nil {
+			t.Fatal(err)
+		}
+		alerts = append(alerts, batch...)
+	}
+	if len(alerts) != 4 {
+		t.Fatalf("expected two bans and two unbans, got %+v", alerts)
+	}
+	// unbans follow bans, in any order
+	for _, ban := range alerts[:2] {
+		i := slices.IndexFunc(alerts[2:], func(a alert) bool { return maps.Equal(a.Labels, ban.Labels) })
+		if i < 0 || alerts[2+i].EndsAt.After(time.Now()) {
+			t.Errorf("ban %+v not resolved by %+v", ban, alerts[2:])
+		}
+	}
+	if ip := alerts[0].Labels["ip"]; ip != "2001:db8:0:1::/64" {
+		t.Errorf("ban of client prefix labelled %q", ip)
+	}
+}
+
+func TestNotifierRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		requests int
+	}{
+		{"unavailable retried", []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, 3},
+		{"rejected not retried", []int{http.StatusBadRequest}, 1},
+		{"gives up", []int{500, 500, 500, 500}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, reqs := standIn(tt.statuses...)
+			defer srv.Close()
+			sink, _ := lib.NewSink(lib.SinkWebhook, srv.URL, "")
+			n := lib.NewNotifier(sink, 0, 0)
+			n.Retries, n.Backoff = 2, time.Millisecond
+			bus := lib.NewEventBus(0, 0, n)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go bus.Run(ctx)
+
+			bus.Publish(lib.Event{Kind: lib.EventBan, IP: "203.0.113.1"})
+			for range tt.requests {
+				receive(t, reqs)
+			}
+			select {
+			case <-reqs:
+				t.Errorf("more than %d requests", tt.requests)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestNotifierInterval(t *testing.T) {
+	srv, reqs := standIn()
+	defer srv.Close()
+	sink, _ := lib.NewSink(lib.SinkWebhook, srv.URL, "")
+	n := lib.NewNotifier(sink, 0, 200*time.Millisecond)
+	n.Events = []string{lib.EventBan}
+	bus := lib.NewEventBus(0, 0, n)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Run(ctx)
+
+	bus.Publish(lib.Event{Kind: lib.EventBan, IP: "203.0.113.1"})
+	start := time.Now()
+	receive(t, reqs)
+
+	// events after first send wait for interval and go out together, unsubscribed kinds are skipped
+	bus.Publish(lib.Event{Kind: lib.EventBan, IP: "203.0.113.2"})
+	bus.Publish(lib.Event{Kind: lib.EventUnban, IP: "203.0.113.1"})
+	bus.Publish(lib.Event{Kind: lib.EventBan, IP: "203.0.113.3"})
+	r := receive(t, reqs)
+	if time.Since(start) < 150*time.Millisecond {
+		t.Errorf("second batch sent after %v", time.Since(start))
+	}
+	if strings.Count(r.body, `"kind":"ban"`) != 2 || strings.Contains(r.body, "unban") {
+		t.Errorf("unexpected batch %s", r.body)
+	}
+}
+
+func TestStorm(t *testing.T) {
+	srv, reqs := standIn()
+	defer srv.Close()
+	sink, _ := lib.NewSink(lib.SinkAlertmanager, srv.URL, "")
+	bus := lib.NewEventBus(3, 100*time.Millisecond, lib.NewNotifier(sink, 0, 0))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Run(ctx)
+
+	vars := &lib.EnvVars{BucketLimit: 1, BucketRate: 1}
+	bucket := lib.NewEventBucket(lib.NewBucket(vars), bus)
+	for range 4 {
+		bucket.GetToken("203.0.113.1")
+	}
+	bucket.GetToken("203.0.113.2")
+	bucket.GetToken("203.0.113.2")
+
+	r := receive(t, reqs)
+	if r.path != "/api/v2/alerts" {
+		t.Errorf("posted to %s", r.path)
+	}
+	var alerts []struct {
+		Labels      map[string]string
+		Annotations map[string]string
+		EndsAt      time.Time
+	}
+	if err := json.Unmarshal([]byte(r.body), &alerts); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 1 || alerts[0].Labels["alertname"] != "RateLimiterStorm" ||
+		alerts[0].Annotations["busiest_client"] != "203.0.113.1" || alerts[0].EndsAt.IsZero() {
+		t.Errorf("unexpected alerts %s", r.body)
+	}
+	if !strings.Contains(alerts[0].Annotations["summary"], "4 requests rate limited") {
+		t.Errorf("unexpected summary %q", alerts[0].Annotations["summary"])
+	}
+}
+
+func TestSinks(t *testing.T) {
+	until := time.Now().Add(time.Hour)
+	events := []lib.Event{
+		{Kind: lib.EventBan, IP: "203.0.113.1", Reason: "strike limit", Time: time.Now(), Until: until},
+		{Kind: lib.EventUnban, IP: "203.0.113.0/24", Count: 1, Time: time.Now()},
+	}
+	tests := []struct {
+		kind  string
+		want  []string
+		check func(r request) bool
+	}{
+		{lib.SinkNtfy, []string{"203.0.113.1 banned until", "203.0.113.0/24 unbanned"}, func(r request) bool {
+			return r.header.Get("Title") == "ratelimiter: 2 events" && r.header.Get("Tags") == "shield"
+		}},
+		{lib.SinkHomeAssistant, []string{`"bans":1`, `"unbans":1`, `"message":"203.0.113.1 banned`}, nil},
+		{lib.SinkAlertmanager, []string{`"alertname":"RateLimiterBan"`, `"ip":"203.0.113.0/24"`}, func(r request) bool {
+			return r.path == "/api/v2/alerts"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			srv, reqs := standIn()
+			defer srv.Close()
+			sink, err := lib.NewSink(tt.kind, srv.URL, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = sink.Send(context.Background(), events); err != nil {
+				t.Fatal(err)
+			}
+			r := receive(t, reqs)
+			for _, w := range tt.want {
+				if !strings.Contains(r.body, w) {
+					t.Errorf("missing %q in %s", w, r.body)
+				}
+			}
+			if tt.check != nil && !tt.check(r) {
+				t.Errorf("unexpected request %+v", r)
+			}
+		})
+	}
+}
+
+func TestParseNotifiers(t *testing.T) {
+	vars := &lib.EnvVars{NotifyBatch: time.Second, NotifyInterval: time.Minute, NotifyBatchMax: 10, NotifyRetries: 2}
+	t.Setenv("NTFY_TOKEN", "tk")
+	n, err := lib.ParseNotifiers("ntfy https://ntfy.sh/bans events=ban,storm token_env=NTFY_TOKEN interval=5m;"+
+		" alertmanager http://alertmanager:9093", vars)
+	if err != nil || len(n) != 2 {
+		t.Fatalf("got %v, %v", n, err)
+	}
+	if n[0].Sink.Name() != lib.SinkNtfy || n[0].Interval != 5*time.Minute || len(n[0].Events) != 2 ||
+		n[0].Batch != time.Second || n[1].MaxBatch != 10 || n[1].Retries != 2 {
+		t.Errorf("unexpected notifiers %+v %+v", n[0], n[1])
+	}
+
+	for _, spec := range []string{"ntfy", "pager https://x", "webhook https://x events=kick", "webhook https://x foo=1"} {
+		if _, err = lib.ParseNotifiers(spec, vars); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+}
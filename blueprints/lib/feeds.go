@@ -0,0 +1,294 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Feed formats, plain covers FireHOL netsets and Spamhaus DROP
+const (
+	FeedPlain    = "plain"
+	FeedCrowdSec = "crowdsec"
+
+	feedListPrefix   = "feed:"
+	feedMaxSize      = 64 << 20
+	feedStaleFactor  = 4
+	feedDefaultEvery = time.Hour
+)
+
+var ErrFeed = errors.New("invalid feed")
+
+// Feed periodically pulls external blocklist into a deny list named "feed:<name>". Entries are
+// dropped once feed wasn't refreshed successfully for MaxAge, zero MaxAge keeps them forever.
+type Feed struct {
+	Name     string
+	URL      string
+	Format   string
+	Interval time.Duration
+	MaxAge   time.Duration
+	APIKey   string
+
+	list   *PrefixList
+	client *http.Client
+	etag   string
+	// synced is set after full crowdsec decision set was received, later pulls are incremental
+	synced bool
+	lastOK atomic.Int64
+	clock  Clock
+}
+
+// NewFeed creates feed, clock defaults to time.Now when nil
+func NewFeed(name, url, format string, interval, maxAge time.Duration, clock Clock) *Feed {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &Feed{
+		Name:     name,
+		URL:      url,
+		Format:   format,
+		Interval: interval,
+		MaxAge:   maxAge,
+		list:     NewPrefixList(feedListPrefix+name, nil),
+		client:   &http.Client{Timeout: 30 * time.Second},
+		clock:    clock,
+	}
+}
+
+// ParseFeeds parses ';' separated feeds in form
+// "<name> <url> [format=plain|crowdsec] [interval=1h] [max_age=4h] [key_env=VAR]",
+// max_age defaults to four intervals, api key is read from environment variable key_env
+func ParseFeeds(spec string) ([]*Feed, error) {
+	var feeds []*Feed
+	for rule := range strings.SplitSeq(spec, ";") {
+		f := strings.Fields(rule)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) < 2 {
+			return nil, errors.Join(ErrFeed, errors.New(rule))
+		}
+
+		feed := NewFeed(f[0], f[1], FeedPlain, feedDefaultEvery, -1, nil)
+		for _, opt := range f[2:] {
+			k, v, _ := strings.Cut(opt, "=")
+			var err error
+			switch k {
+			case "format":
+				feed.Format = v
+			case "interval":
+				feed.Interval, err = time.ParseDuration(v)
+			case "max_age":
+				feed.MaxAge, err = time.ParseDuration(v)
+			case "key_env":
+				feed.APIKey = os.Getenv(v)
+			default:
+				err = errors.New(opt)
+			}
+			if err != nil {
+				return nil, errors.Join(ErrFeed, err)
+			}
+		}
+
+		switch {
+		case feed.Format != FeedPlain && feed.Format != FeedCrowdSec:
+			return nil, errors.Join(ErrFeed, errors.New("unknown format "+feed.Format))
+		case feed.Interval <= 0:
+			return nil, errors.Join(ErrFeed, errors.New("interval must be positive"))
+		case feed.MaxAge < 0:
+			feed.MaxAge = feedStaleFactor * feed.Interval
+		}
+		feeds = append(feeds, feed)
+	}
+	return feeds, nil
+}
+
+func (f *Feed) List() *PrefixList {
+	return f.list
+}
+
+// LastSuccess returns time of the last successful refresh
+func (f *Feed) LastSuccess() time.Time {
+	if ns := f.lastOK.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// Run refreshes feed every interval until ctx is done, failures keep previous entries until
+// they get stale
+func (f *Feed) Run(ctx context.Context) {
+	t := time.NewTicker(f.Interval)
+	defer t.Stop()
+	for {
+		if err := f.Refresh(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("refreshing feed", "feed", f.Name, "val", err.Error())
+		}
+		f.Expire()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (f *Feed) Refresh(ctx context.Context) error {
+	target := f.URL
+	if f.Format == FeedCrowdSec {
+		target = strings.TrimSuffix(f.URL, "/") + "/v1/decisions/stream"
+		if !f.synced {
+			target += "?startup=true"
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	if f.APIKey != "" {
+		req.Header.Set("X-Api-Key", f.APIKey)
+	}
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		f.lastOK.Store(f.clock().UnixNano())
+		return nil
+	default:
+		return errors.New("unexpected status " + resp.Status)
+	}
+
+	body := io.LimitReader(resp.Body, feedMaxSize)
+	if f.Format == FeedCrowdSec {
+		err = f.applyDecisions(body)
+	} else {
+		err = f.replace(body, resp.Header.Get("ETag"))
+	}
+	if err != nil {
+		return err
+	}
+	f.lastOK.Store(f.clock().UnixNano())
+	return nil
+}
+
+func (f *Feed) replace(body io.Reader, etag string) error {
+	prefixes, invalid, err := ParsePrefixes(body)
+	if err != nil {
+		return err
+	}
+	if invalid > 0 {
+		slog.Warn("skipped invalid feed entries", "feed", f.Name, "val", invalid)
+	}
+	f.list.Replace(prefixes)
+	f.etag = etag
+	slog.Info("feed refreshed", "feed", f.Name, "val", len(prefixes))
+	return nil
+}
+
+type crowdSecDecision struct {
+	Scope string `json:"scope"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type crowdSecStream struct {
+	New     []crowdSecDecision `json:"new"`
+	Deleted []crowdSecDecision `json:"deleted"`
+}
+
+// applyDecisions applies crowdsec stream, first response is the full set of active decisions
+func (f *Feed) applyDecisions(body io.Reader) error {
+	var stream crowdSecStream
+	if err := json.NewDecoder(body).Decode(&stream); err != nil {
+		return err
+	}
+
+	add, remove := crowdSecPrefixes(stream.New), crowdSecPrefixes(stream.Deleted)
+	if f.synced {
+		f.list.Update(add, remove)
+	} else {
+		f.list.Replace(add)
+		f.synced = true
+	}
+	slog.Info("feed refreshed", "feed", f.Name, "val", f.list.Len(), "new", len(add), "deleted", len(remove))
+	return nil
+}
+
+func crowdSecPrefixes(decisions []crowdSecDecision) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(decisions))
+	for _, d := range decisions {
+		scope := strings.ToLower(d.Scope)
+		if !strings.EqualFold(d.Type, "ban") || (scope != "ip" && scope != "range") {
+			continue
+		}
+		if p, err := ParsePrefix(d.Value); err == nil {
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes
+}
+
+// Expire drops entries of feed not refreshed successfully for MaxAge, next refresh starts from
+// scratch
+func (f *Feed) Expire() {
+	if f.MaxAge <= 0 || f.list.Len() == 0 || f.clock().Sub(f.LastSuccess()) <= f.MaxAge {
+		return
+	}
+	slog.Warn("feed stale, dropping entries", "feed", f.Name, "val", f.list.Len(), "last_success", f.LastSuccess())
+	f.list.Replace(nil)
+	f.etag = ""
+	f.synced = false
+}
+
+// feedCollector exports state of reputation feeds
+type feedCollector struct {
+	feeds   []*Feed
+	entries *prometheus.Desc
+	success *prometheus.Desc
+}
+
+func newFeedCollector(feeds []*Feed) *feedCollector {
+	return &feedCollector{
+		feeds: feeds,
+		entries: prometheus.NewDesc("reputation_feed_entries",
+			"Networks currently loaded from feed", []string{"feed"}, nil),
+		success: prometheus.NewDesc("reputation_feed_last_success_timestamp_seconds",
+			"Time of the last successful feed refresh", []string{"feed"}, nil),
+	}
+}
+
+func (c *feedCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.entries
+	ch <- c.success
+}
+
+func (c *feedCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, f := range c.feeds {
+		ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, float64(f.list.Len()), f.Name)
+		var ts float64
+		if last := f.LastSuccess(); !last.IsZero() {
+			ts = float64(last.Unix())
+		}
+		ch <- prometheus.MustNewConstMetric(c.success, prometheus.GaugeValue, ts, f.Name)
+	}
+}
@@ -0,0 +1,165 @@
+package lib_test
+
+import (
+	"context"
+	"io"
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const fireholSet = `#
+# firehol_level1
+#
+0.0.0.0/8
+192.0.2.0/24
+198.51.100.17
+`
+
+func TestParseFeeds(t *testing.T) {
+	t.Setenv("CS_KEY", "k")
+	feeds, err := lib.ParseFeeds("firehol https://x/level1.netset interval=12h; " +
+		"cs http://crowdsec:8080 format=crowdsec interval=1m max_age=0 key_env=CS_KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feeds) != 2 || feeds[0].MaxAge != 48*time.Hour || feeds[1].MaxAge != 0 || feeds[1].APIKey != "k" {
+		t.Errorf("unexpected feeds %+v %+v", feeds[0], feeds[1])
+	}
+	if feeds[0].List().Name != "feed:firehol" {
+		t.Errorf("list named %s", feeds[0].List().Name)
+	}
+
+	for _, spec := range []string{"lonely", "x http://x format=xml", "x http://x interval=0s", "x http://x bogus=1"} {
+		if _, err := lib.ParseFeeds(spec); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+}
+
+func TestPlainFeed(t *testing.T) {
+	var hits, notModified atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = io.WriteString(w, fireholSet)
+	}))
+	defer srv.Close()
+
+	f := lib.NewFeed("firehol", srv.URL, lib.FeedPlain, time.Hour, 0, nil)
+	ctx := context.Background()
+	if err := f.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if f.List().Len() != 3 || !f.List().Contains(netip.MustParseAddr("192.0.2.55")) {
+		t.Errorf("feed loaded %v", f.List().List())
+	}
+	if err := f.Refresh(ctx); err != nil || notModified.Load() != 1 || f.List().Len() != 3 {
+		t.Errorf("conditional refresh: %v, %d not modified", err, notModified.Load())
+	}
+	if f.LastSuccess().IsZero() {
+		t.Error("last success not recorded")
+	}
+}
+
+func TestCrowdSecFeed(t *testing.T) {
+	responses := []string{
+		`{"new":[{"scope":"Ip","type":"ban","value":"203.0.113.1"},` +
+			`{"scope":"Range","type":"ban","value":"198.51.100.0/24"},` +
+			`{"scope":"Ip","type":"captcha","value":"203.0.113.2"}],"deleted":null}`,
+		`{"new":[{"scope":"Ip","type":"ban","value":"203.0.113.3"}],` +
+			`"deleted":[{"scope":"Ip","type":"ban","value":"203.0.113.1"}]}`,
+	}
+	var startup []bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/decisions/stream" || r.Header.Get("X-Api-Key") != "key" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		startup = append(startup, r.URL.Query().Get("startup") == "true")
+		_, _ = io.WriteString(w, responses[min(len(startup), len(responses))-1])
+	}))
+	defer srv.Close()
+
+	f := lib.NewFeed("crowdsec", srv.URL, lib.FeedCrowdSec, time.Hour, 0, nil)
+	f.APIKey = "key"
+	ctx := context.Background()
+	if err := f.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(startup) != 2 || !startup[0] || startup[1] {
+		t.Errorf("startup flags %v", startup)
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"203.0.113.1", false},
+		{"203.0.113.2", false},
+		{"203.0.113.3", true},
+		{"198.51.100.200", true},
+	}
+	for _, tt := range tests {
+		if got := f.List().Contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("%s: got %t", tt.addr, got)
+		}
+	}
+}
+
+func TestFeedStale(t *testing.T) {
+	var fail atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, fireholSet)
+	}))
+	defer srv.Close()
+
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+	f := lib.NewFeed("firehol", srv.URL, lib.FeedPlain, time.Hour, 4*time.Hour, clock.Now)
+	lists := lib.NewAccessLists()
+	lists.AddFeed(f)
+
+	ctx := context.Background()
+	if err := f.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !f.LastSuccess().Equal(clock.now) {
+		t.Errorf("last success %v", f.LastSuccess())
+	}
+	addr := netip.MustParseAddr("198.51.100.17")
+	if name, _, ok := lists.Denied(addr); !ok || name != "feed:firehol" {
+		t.Fatalf("feed entry not denied, matched %q", name)
+	}
+
+	// failures keep entries until they get stale
+	fail.Store(true)
+	clock.Advance(3 * time.Hour)
+	if err := f.Refresh(ctx); err == nil {
+		t.Fatal("failed refresh succeeded")
+	}
+	f.Expire()
+	if f.List().Len() == 0 {
+		t.Error("entries dropped before max age")
+	}
+	clock.Advance(2 * time.Hour)
+	f.Expire()
+	if _, _, ok := lists.Denied(addr); ok || f.List().Len() != 0 {
+		t.Error("stale entries kept")
+	}
+}
@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrRate = errors.New("invalid rate")
+
+// Rate is number of events per second, fractions allowed
+type Rate float64
+
+// ParseRate parses "<n>[/s|/m|/min|/h]", plain number is per second, e.g. "0.5/s" or "100/min"
+func ParseRate(v string) (Rate, error) {
+	n, unit, _ := strings.Cut(strings.TrimSpace(v), "/")
+	f, err := strconv.ParseFloat(n, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, errors.Join(ErrRate, errors.New(v))
+	}
+	switch unit {
+	case "", "s", "sec":
+		return Rate(f), nil
+	case "m", "min":
+		return Rate(f / 60), nil
+	case "h", "hour":
+		return Rate(f / 3600), nil
+	}
+	return 0, errors.Join(ErrRate, errors.New("unknown unit "+unit))
+}
+
+func (r *Rate) UnmarshalText(text []byte) error {
+	v, err := ParseRate(string(text))
+	if err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
+
+func (r Rate) String() string {
+	return strconv.FormatFloat(float64(r), 'g', -1, 64) + "/s"
+}
+
+// Interval returns time between two events, capped so 1<<20 intervals don't overflow, which leaves
+// non-positive rate practically never refilling
+func (r Rate) Interval() time.Duration {
+	if r <= 0 || float64(time.Second)/float64(r) > math.MaxInt64>>20 {
+		return math.MaxInt64 >> 20
+	}
+	return max(time.Duration(float64(time.Second)/float64(r)), 1)
+}
+
+// Duration returns time n events take at rate, overflowing values are capped
+func (r Rate) Duration(n float64) time.Duration {
+	d := n / float64(r) * float64(time.Second)
+	if r <= 0 || d >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(math.Ceil(max(d, 0)))
+}
+
+// Clock returns current time, buckets use time.Now when nil
+type Clock func() time.Time
+
+// GCRA is Bucket allowing burst requests at once, refilled continuously at rate. As generic cell
+// rate algorithm it keeps only theoretical arrival time of next request, tat, which runs ahead of
+// now by interval per consumed token and falls back to now as they refill.
+type GCRA struct {
+	interval  time.Duration
+	tolerance time.Duration
+	clock     Clock
+
+	tat time.Time
+	mu  sync.Mutex
+}
+
+// NewGCRA creates full bucket of burst tokens, burst is capped to 1<<20
+func NewGCRA(rate Rate, burst int, clock Clock) *GCRA {
+	if clock == nil {
+		clock = time.Now
+	}
+	burst = min(max(burst, 0), 1<<20)
+	interval := rate.Interval()
+	return &GCRA{
+		interval:  interval,
+		tolerance: interval * time.Duration(burst),
+		clock:     clock,
+	}
+}
+
+// slack returns unused tolerance, capacity left in time units, never negative as tat runs at most
+// tolerance ahead, caller must hold mu
+func (g *GCRA) slack(now time.Time) time.Duration {
+	if g.tat.Before(now) {
+		return g.tolerance
+	}
+	return g.tolerance - g.tat.Sub(now)
+}
+
+func (g *GCRA) GetToken(_ string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.take(g.clock())
+}
+
+// Take consumes token like GetToken and returns quota left after it
+func (g *GCRA) Take(_ string) (bool, Quota) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.clock()
+	ok := g.take(now)
+	return ok, g.quota(now)
+}
+
+// take consumes token if available, caller must hold mu
+func (g *GCRA) take(now time.Time) bool {
+	if g.slack(now) < g.interval {
+		return false
+	}
+	if g.tat.Before(now) {
+		g.tat = now
+	}
+	g.tat = g.tat.Add(g.interval)
+	return true
+}
+
+// Remaining returns number of requests allowed right now
+func (g *GCRA) Remaining(_ string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.remaining(g.clock())
+}
+
+func (g *GCRA) remaining(now time.Time) int {
+	return int(g.slack(now) / g.interval)
+}
+
+// NextToken returns time until one more token is available, zero for full bucket
+func (g *GCRA) NextToken(_ string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.nextToken(g.clock())
+}
+
+func (g *GCRA) nextToken(now time.Time) time.Duration {
+	slack := g.slack(now)
+	if slack >= g.tolerance {
+		return 0
+	}
+	return g.interval - slack%g.interval
+}
+
+// Quota reports burst as the limit, which refills completely within burst intervals
+func (g *GCRA) Quota(_ string) Quota {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.quota(g.clock())
+}
+
+func (g *GCRA) quota(now time.Time) Quota {
+	return Quota{
+		Limit:      int(g.tolerance / g.interval),
+		Window:     g.tolerance,
+		Remaining:  g.remaining(now),
+		Reset:      g.tolerance - g.slack(now),
+		RetryAfter: g.retryAfter(now),
+	}
+}
+
+// RetryAfter returns time until next request is allowed, zero if token is available
+func (g *GCRA) RetryAfter(_ string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.retryAfter(g.clock())
+}
+
+func (g *GCRA) retryAfter(now time.Time) time.Duration {
+	if g.remaining(now) > 0 {
+		return 0
+	}
+	return g.nextToken(now)
+}
@@ -0,0 +1,130 @@
+package lib_test
+
+import (
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want lib.Rate
+		err  bool
+	}{
+		{"2", 2, false},
+		{"0.5/s", 0.5, false},
+		{"100/min", 100.0 / 60, false},
+		{"30/m", 0.5, false},
+		{"360/h", 0.1, false},
+		{"0", 0, false},
+		{"-1/s", 0, true},
+		{"1/d", 0, true},
+		{"fast", 0, true},
+		{"NaN/s", 0, true},
+		{"nan", 0, true},
+		{"Inf/min", 0, true},
+		{"+Inf", 0, true},
+		{"-Inf/h", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := lib.ParseRate(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseRate(%q) got %v, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestGCRA(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+	g := lib.NewGCRA(2, 3, clock.Now)
+
+	for i := range 3 {
+		if g.Remaining("") != 3-i || !g.GetToken("") {
+			t.Fatalf("burst request %d rejected", i)
+		}
+	}
+	if g.GetToken("") || g.RetryAfter("") != 500*time.Millisecond {
+		t.Fatalf("empty bucket allowed request, retry after %v", g.RetryAfter(""))
+	}
+
+	// refill is continuous, not rounded to whole seconds
+	clock.Advance(300 * time.Millisecond)
+	if g.GetToken("") || g.NextToken("") != 200*time.Millisecond {
+		t.Errorf("next token in %v", g.NextToken(""))
+	}
+	clock.Advance(200 * time.Millisecond)
+	if !g.GetToken("") {
+		t.Error("refilled token rejected")
+	}
+
+	clock.Advance(time.Hour)
+	if g.Remaining("") != 3 || g.NextToken("") != 0 || g.RetryAfter("") != 0 {
+		t.Errorf("idle bucket not full: %d", g.Remaining(""))
+	}
+
+	slow := lib.NewGCRA(100.0/60, 1, clock.Now)
+	slow.GetToken("")
+	if d := slow.RetryAfter(""); d != 600*time.Millisecond {
+		t.Errorf("100/min retry after %v", d)
+	}
+}
+
+// TestGCRAProperties checks random traffic against the rate contract: over any span no more than
+// burst + rate*span requests pass, Remaining and RetryAfter predict GetToken exactly
+func TestGCRAProperties(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	for range 200 {
+		rate := lib.Rate(0.1 + r.Float64()*20)
+		burst := 1 + r.IntN(20)
+		clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+		g := lib.NewGCRA(rate, burst, clock.Now)
+		start := clock.now
+
+		allowed := 0
+		for range 500 {
+			clock.Advance(time.Duration(r.Int64N(int64(2 * rate.Interval()))))
+
+			n := g.Remaining("")
+			if n < 0 || n > burst {
+				t.Fatalf("rate %v burst %d: remaining %d", rate, burst, n)
+			}
+			for i := range n {
+				if !g.GetToken("") {
+					t.Fatalf("rate %v burst %d: request %d of %d remaining rejected", rate, burst, i, n)
+				}
+				allowed++
+			}
+			if g.GetToken("") {
+				t.Fatalf("rate %v burst %d: request over remaining allowed", rate, burst)
+			}
+
+			retry := g.RetryAfter("")
+			if retry <= 0 || retry > rate.Interval() {
+				t.Fatalf("rate %v burst %d: retry after %v", rate, burst, retry)
+			}
+			clock.Advance(retry - 1)
+			if g.GetToken("") {
+				t.Fatalf("rate %v burst %d: allowed before retry after", rate, burst)
+			}
+			clock.Advance(1)
+			if g.Remaining("") != 1 {
+				t.Fatalf("rate %v burst %d: token not refilled after retry after", rate, burst)
+			}
+
+			span := clock.now.Sub(start)
+			if limit := float64(burst) + float64(rate)*span.Seconds() + 1e-6; float64(allowed) > limit {
+				t.Fatalf("rate %v burst %d: %d requests within %v", rate, burst, allowed, span)
+			}
+		}
+	}
+}
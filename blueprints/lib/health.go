@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// StartHealthChecks probes every upstream periodically until ctx is done, upstreams answering
+// with 5xx or not answering to fails probes in a row are taken out of their pool until the next
+// successful probe
+func StartHealthChecks(
+	ctx context.Context, routes []*Route, path string, interval, timeout time.Duration, fails int,
+) {
+	if interval <= 0 {
+		return
+	}
+	client := &http.Client{Timeout: timeout}
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			for _, r := range routes {
+				for _, u := range r.Pool.Targets {
+					checkUpstream(ctx, client, r.Name, u, path, fails)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+func checkUpstream(ctx context.Context, client *http.Client, route string, u *Upstream, path string, fails int) {
+	healthy := false
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.URL.JoinPath(path).String(), nil)
+	if err == nil {
+		resp, err := client.Do(req)
+		if err == nil {
+			_ = resp.Body.Close()
+			healthy = resp.StatusCode < http.StatusInternalServerError
+		}
+	}
+
+	// single failed probe doesn't take upstream out
+	if !healthy && int(u.fails.Add(1)) < fails {
+		return
+	}
+	if healthy {
+		u.fails.Store(0)
+	}
+	if u.down.Swap(!healthy) == healthy {
+		slog.Warn("upstream health changed", "route", route, "target", u.URL.String(), "healthy", healthy)
+	}
+}
+
+// poolCollector exports state of upstream pools
+type poolCollector struct {
+	routes []*Route
+	up     *prometheus.Desc
+	active *prometheus.Desc
+}
+
+func newPoolCollector(routes []*Route) *poolCollector {
+	return &poolCollector{
+		routes: routes,
+		up: prometheus.NewDesc("upstream_up",
+			"Upstream health state, 1 healthy, 0 taken out of pool", []string{"route", "target"}, nil),
+		active: prometheus.NewDesc("upstream_active_requests",
+			"Requests in flight per upstream", []string{"route", "target"}, nil),
+	}
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.up
+	ch <- c.active
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, r := range c.routes {
+		for _, u := range r.Pool.Targets {
+			up := 0.0
+			if u.Healthy() {
+				up = 1
+			}
+			ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, up, r.Name, u.URL.String())
+			ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, float64(u.Active()), r.Name, u.URL.String())
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"net/netip"
+	"time"
+)
+
+// ClientPrefix aggregates client addresses to networks of given length, so e.g. whole IPv6 /64
+// shares strikes, bans and tokens. Full length keeps plain address as the key.
+type ClientPrefix struct {
+	V4 int
+	V6 int
+}
+
+// Key returns identity of ip, unparsable values are returned unchanged
+func (c ClientPrefix) Key(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap().WithZone("")
+	bits := c.V4
+	if addr.Is6() {
+		bits = c.V6
+	}
+	if bits <= 0 || bits >= addr.BitLen() {
+		return addr.String()
+	}
+	p, err := addr.Prefix(bits)
+	if err != nil {
+		return addr.String()
+	}
+	return p.String()
+}
+
+func (c ClientPrefix) aggregates() bool {
+	return (c.V4 > 0 && c.V4 < 32) || (c.V6 > 0 && c.V6 < 128)
+}
+
+type prefixFilter struct {
+	ClientFilter
+	prefix ClientPrefix
+}
+
+// NewPrefixFilter keys filter by client prefix, filter is returned as is without aggregation
+func NewPrefixFilter(f ClientFilter, prefix ClientPrefix) ClientFilter {
+	if !prefix.aggregates() {
+		return f
+	}
+	return &prefixFilter{ClientFilter: f, prefix: prefix}
+}
+
+func (p *prefixFilter) NotifyFailure(ip string, weight float64) time.Duration {
+	return p.ClientFilter.NotifyFailure(p.prefix.Key(ip), weight)
+}
+
+func (p *prefixFilter) CheckBlocked(ip string) bool {
+	return p.ClientFilter.CheckBlocked(p.prefix.Key(ip))
+}
+
+func (p *prefixFilter) BannedFor(ip string) time.Duration {
+	return p.ClientFilter.BannedFor(p.prefix.Key(ip))
+}
+
+func (p *prefixFilter) Ban(ip string, d time.Duration, reason string) {
+	p.ClientFilter.Ban(p.prefix.Key(ip), d, reason)
+}
+
+type prefixBucket struct {
+	Bucket
+	prefix ClientPrefix
+}
+
+// NewPrefixBucket keys bucket by client prefix, bucket is returned as is without aggregation
+func NewPrefixBucket(b Bucket, prefix ClientPrefix) Bucket {
+	if !prefix.aggregates() {
+		return b
+	}
+	return &prefixBucket{Bucket: b, prefix: prefix}
+}
+
+func (p *prefixBucket) GetToken(key string) bool {
+	return p.Bucket.GetToken(p.prefix.Key(key))
+}
+
+func (p *prefixBucket) RetryAfter(key string) time.Duration {
+	return p.Bucket.RetryAfter(p.prefix.Key(key))
+}
+
+func (p *prefixBucket) Quota(key string) Quota {
+	return p.Bucket.Quota(p.prefix.Key(key))
+}
+
+func (p *prefixBucket) Take(key string) (bool, Quota) {
+	return p.Bucket.Take(p.prefix.Key(key))
+}
@@ -0,0 +1,121 @@
+package lib_test
+
+import (
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestClientPrefixKey(t *testing.T) {
+	tests := []struct {
+		prefix lib.ClientPrefix
+		ip     string
+		want   string
+	}{
+		{lib.ClientPrefix{V4: 32, V6: 64}, "203.0.113.9", "203.0.113.9"},
+		{lib.ClientPrefix{V4: 32, V6: 64}, "2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{lib.ClientPrefix{V4: 32, V6: 64}, "::ffff:203.0.113.9", "203.0.113.9"},
+		{lib.ClientPrefix{V4: 24, V6: 128}, "203.0.113.9", "203.0.113.0/24"},
+		{lib.ClientPrefix{V4: 24, V6: 128}, "fe80::1%eth0", "fe80::1"},
+		{lib.ClientPrefix{}, "2001:db8::1", "2001:db8::1"},
+		{lib.ClientPrefix{V4: 32, V6: 64}, "unix", "unix"},
+	}
+	for _, tt := range tests {
+		if got := tt.prefix.Key(tt.ip); got != tt.want {
+			t.Errorf("%+v key of %s got %s want %s", tt.prefix, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCutPort(t *testing.T) {
+	tests := map[string]string{
+		"example.com:8080":  "example.com",
+		"example.com":       "example.com",
+		"192.0.2.1:80":      "192.0.2.1",
+		"[2001:db8::1]:443": "2001:db8::1",
+		"[2001:db8::1]":     "2001:db8::1",
+		"2001:db8::1":       "2001:db8::1",
+	}
+	for in, want := range tests {
+		if got := lib.CutPort(in); got != want {
+			t.Errorf("CutPort(%q) got %q want %q", in, got, want)
+		}
+	}
+}
+
+func TestClientAddrPorts(t *testing.T) {
+	trusted := lib.TrustedProxies{netip.MustParsePrefix("10.0.0.0/8")}
+	peer := netip.MustParseAddr("10.0.0.1")
+
+	tests := []struct {
+		xff  string
+		real string
+		want string
+	}{
+		{"[2001:db8::5]:51000", "", "2001:db8::5"},
+		{"192.0.2.7:4000, 10.0.0.2", "", "192.0.2.7"},
+		{"::ffff:192.0.2.7", "", "192.0.2.7"},
+		{"", "[2001:db8::6]", "2001:db8::6"},
+	}
+	for _, tt := range tests {
+		var xff []string
+		if tt.xff != "" {
+			xff = []string{tt.xff}
+		}
+		if got := trusted.ClientAddr(peer, xff, tt.real).String(); got != tt.want {
+			t.Errorf("xff %q real %q got %s want %s", tt.xff, tt.real, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixAggregation(t *testing.T) {
+	vars := &lib.EnvVars{BucketLimit: 1, BucketRate: 1, RateLimitStatus: http.StatusTooManyRequests}
+	prefix := lib.ClientPrefix{V4: 32, V6: 64}
+	blocker := lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{}, 0)
+	filter := lib.NewPrefixFilter(blocker, prefix)
+	bucket := lib.NewPrefixBucket(lib.NewBucket(vars), prefix)
+
+	backend := echoServer("backend")
+	defer backend.Close()
+	targets, _ := lib.ParseTargets(backend.URL)
+	routes := lib.NewRouteTable()
+	_ = routes.Add("example.com", &lib.Route{Prefix: "/", Pool: lib.NewPool("", targets)})
+	handler := lib.InitServer(filter, bucket, vars, testMetrics(), routes, nil, nil).Handler
+
+	get := func(remote string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := get("[2001:db8:0:1::1]:1234"); code != http.StatusOK {
+		t.Fatalf("first request got %d", code)
+	}
+	// neighbour in same /64 shares the bucket
+	if code := get("[2001:db8:0:1::2]:1234"); code != http.StatusTooManyRequests {
+		t.Errorf("same /64 got %d", code)
+	}
+	if code := get("[2001:db8:0:2::1]:1234"); code != http.StatusOK {
+		t.Errorf("other /64 got %d", code)
+	}
+	if code := get("192.0.2.1:1234"); code != http.StatusOK {
+		t.Errorf("ipv4 got %d", code)
+	}
+
+	filter.Ban("2001:db8:0:3::1", time.Hour, "test")
+	if !filter.CheckBlocked("2001:db8:0:3::ffff") || filter.CheckBlocked("2001:db8:0:4::1") {
+		t.Error("ban not applied to /64")
+	}
+	list := blocker.List()
+	if len(list) != 1 || list[0].IP != "2001:db8:0:3::/64" {
+		t.Fatalf("unexpected records %+v", list)
+	}
+	if n := blocker.Unban(netip.MustParsePrefix("2001:db8:0:3::7/128")); n != 1 {
+		t.Errorf("unban of address in banned prefix removed %d", n)
+	}
+}
@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+)
+
+const (
+	ActionBan    = "ban"
+	ActionStrike = "strike"
+	ActionTarpit = "tarpit"
+	ActionLog    = "log"
+)
+
+// DefaultMaxTarpits is number of requests held by tarpit rules at once
+const DefaultMaxTarpits = 100
+
+var ErrInspectRule = errors.New("invalid inspection rule")
+
+//go:embed inspect_rules.json
+var defaultInspectRules []byte
+
+// InspectRule matches request by regexes, every set matcher has to match. Headers rule matches if
+// any of the listed headers matches.
+type InspectRule struct {
+	Name      string            `json:"name"`
+	Path      string            `json:"path,omitempty"`
+	Query     string            `json:"query,omitempty"`
+	UserAgent string            `json:"user_agent,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Action    string            `json:"action"`
+	Weight    float64           `json:"weight,omitempty"`
+	Delay     string            `json:"delay,omitempty"`
+
+	path    *regexp.Regexp
+	query   *regexp.Regexp
+	ua      *regexp.Regexp
+	headers map[string]*regexp.Regexp
+	delay   time.Duration
+}
+
+func (i *InspectRule) compile() error {
+	var err error
+	compile := func(p string) *regexp.Regexp {
+		if p == "" || err != nil {
+			return nil
+		}
+		var re *regexp.Regexp
+		re, err = regexp.Compile(p)
+		return re
+	}
+
+	i.path, i.query, i.ua = compile(i.Path), compile(i.Query), compile(i.UserAgent)
+	i.headers = make(map[string]*regexp.Regexp, len(i.Headers))
+	for h, p := range i.Headers {
+		if p != "" {
+			i.headers[http.CanonicalHeaderKey(h)] = compile(p)
+		}
+	}
+	if err != nil {
+		return errors.Join(ErrInspectRule, err)
+	}
+	if i.path == nil && i.query == nil && i.ua == nil && len(i.headers) == 0 {
+		return errors.Join(ErrInspectRule, errors.New(i.Name+": no matcher"))
+	}
+
+	switch i.Action {
+	case ActionBan, ActionLog:
+	case ActionStrike:
+		if i.Weight <= 0 {
+			i.Weight = 1
+		}
+	case ActionTarpit:
+		if i.delay, err = time.ParseDuration(i.Delay); err != nil {
+			return errors.Join(ErrInspectRule, err)
+		}
+	default:
+		return errors.Join(ErrInspectRule, errors.New(i.Name+": unknown action "+i.Action))
+	}
+	return nil
+}
+
+func (i *InspectRule) Match(r *http.Request) bool {
+	if i.path != nil && !i.path.MatchString(r.URL.EscapedPath()) {
+		return false
+	}
+	if i.query != nil && !i.query.MatchString(r.URL.RawQuery) {
+		return false
+	}
+	if i.ua != nil && !i.ua.MatchString(r.UserAgent()) {
+		return false
+	}
+	if len(i.headers) == 0 {
+		return true
+	}
+	for h, re := range i.headers {
+		if v := r.Header.Get(h); v != "" && re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Inspector checks requests against inspection rules, first matching rule wins
+type Inspector struct {
+	rules []*InspectRule
+	// tarpits is semaphore of held requests
+	tarpits chan struct{}
+}
+
+// LoadInspector reads json rules from file, empty path loads builtin scanner ruleset
+func LoadInspector(path string) (*Inspector, error) {
+	data := defaultInspectRules
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return ParseInspector(data)
+}
+
+func ParseInspector(data []byte) (*Inspector, error) {
+	var rules []*InspectRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, errors.Join(ErrInspectRule, err)
+	}
+	for _, r := range rules {
+		if err := r.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return &Inspector{rules: rules, tarpits: make(chan struct{}, DefaultMaxTarpits)}, nil
+}
+
+// SetMaxTarpits limits requests held by tarpit rules at once, zero disables holding. It has to be
+// called before serving.
+func (in *Inspector) SetMaxTarpits(n int) {
+	in.tarpits = make(chan struct{}, max(n, 0))
+}
+
+// Held returns number of requests held by tarpit rules
+func (in *Inspector) Held() int {
+	return len(in.tarpits)
+}
+
+// Tarpit holds request for d or until ctx is done. Requests over the limit are not held, so
+// scanners can't tie up goroutines and connections. Returns false if request was not held.
+func (in *Inspector) Tarpit(ctx context.Context, d time.Duration) bool {
+	select {
+	case in.tarpits <- struct{}{}:
+		defer func() { <-in.tarpits }()
+	default:
+		return false
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	return true
+}
+
+func (in *Inspector) Match(r *http.Request) *InspectRule {
+	if in == nil {
+		return nil
+	}
+	for _, rule := range in.rules {
+		if rule.Match(r) {
+			return rule
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package lib_test
+
+import (
+	"context"
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInspectorBuiltinRules(t *testing.T) {
+	in, err := lib.LoadInspector("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target, ua, rule string
+	}{
+		{"/.env", "curl/8", "dotfiles"},
+		{"/.git/config", "curl/8", "dotfiles"},
+		{"/blog/wp-login.php", "Mozilla/5.0", "wordpress"},
+		{"/search?q=1+UNION+SELECT+pass", "Mozilla/5.0", "injection"},
+		{"/api/search?q=%3Cscript", "Immich_Android", "injection"},
+		{"/?x=${jndi:ldap://x}", "Mozilla/5.0", "jndi-query"},
+		{"/app/config.json", "Mozilla/5.0", "config-leaks"},
+		{"/", "sqlmap/1.7", "scanner-agents"},
+		{"/", "", "empty-agent"},
+		{"/api/assets/1/thumbnail", "Immich_Android", ""},
+		{"/.well-known/acme-challenge/x", "Mozilla/5.0", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		req.Header.Set("User-Agent", tt.ua)
+		got := ""
+		if rule := in.Match(req); rule != nil {
+			got = rule.Name
+		}
+		if got != tt.rule {
+			t.Errorf("%s %q matched %q, expected %q", tt.target, tt.ua, got, tt.rule)
+		}
+	}
+
+	// patterns real users trigger, e.g. searching for a script, only strike
+	for _, target := range []string{"/search?q=%3Cscript", "/config.json"} {
+		if rule := in.Match(httptest.NewRequest(http.MethodGet, target, nil)); rule.Action != lib.ActionStrike {
+			t.Errorf("%s answered by %s", target, rule.Action)
+		}
+	}
+
+	for _, bad := range []string{`[{"name":"x","action":"ban"}]`, `[{"name":"x","path":"/","action":"nope"}]`,
+		`[{"name":"x","path":"(","action":"ban"}]`, `[{"name":"x","path":"/","action":"tarpit"}]`} {
+		if _, err := lib.ParseInspector([]byte(bad)); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestInspectorBans(t *testing.T) {
+	in, err := lib.ParseInspector([]byte(`[{"name":"honeypot","path":"^/\\.env$","action":"ban"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, _ := lib.ParseTargets("http://127.0.0.1:1")
+	routes := lib.NewRouteTable()
+	_ = routes.Add("im.example.top", &lib.Route{Prefix: "/", Pool: lib.NewPool(lib.LBRoundRobin, targets)})
+
+	m := testMetrics()
+	vars := &lib.EnvVars{BucketLimit: 10, BucketRate: 1, BucketIdle: time.Minute, BannedStatus: http.StatusForbidden}
+	blocker := lib.NewIPBlocker(4, time.Hour, lib.JailPolicy{}, 0)
+	handler := lib.InitServer(blocker, lib.NewBucket(vars), vars, m, routes, in, nil).Handler
+
+	serve := func(path string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://im.example.top"+path, nil)
+		req.RemoteAddr = "203.0.113.9:4000"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := serve("/.env"); code != http.StatusForbidden {
+		t.Errorf("honeypot answered %d", code)
+	}
+	if code := serve("/"); code != http.StatusForbidden {
+		t.Errorf("banned client answered %d", code)
+	}
+	if v := testutil.ToFloat64(m.InspectedTotal.WithLabelValues("honeypot", lib.ActionBan)); v != 1 {
+		t.Errorf("honeypot matched %v times", v)
+	}
+}
+
+func TestInspectorTarpit(t *testing.T) {
+	in, err := lib.ParseInspector([]byte(`[{"name":"slow","path":"^/wp-","action":"tarpit","delay":"1h"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.SetMaxTarpits(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	held := make(chan bool)
+	go func() { held <- in.Tarpit(ctx, time.Hour) }()
+
+	for deadline := time.Now().Add(2 * time.Second); in.Held() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("request not held")
+		}
+	}
+	// the only slot is taken, other requests are answered at once
+	if in.Tarpit(context.Background(), time.Hour) {
+		t.Error("tarpit not limited")
+	}
+	cancel()
+	if !<-held {
+		t.Error("first request not held")
+	}
+	if !in.Tarpit(context.Background(), time.Millisecond) {
+		t.Error("slot not released")
+	}
+}
@@ -1,11 +1,26 @@
 package lib
 
+import (
+	"net/netip"
+	"time"
+)
+
 type ClientFilter interface {
-	NotifyFailure(ip string)
+	// NotifyFailure adds strike of weight, returns length of ban it started, zero if it didn't ban
+	NotifyFailure(ip string, weight float64) time.Duration
 	CheckBlocked(ip string) bool
+	BannedFor(ip string) time.Duration
+	Ban(ip string, d time.Duration, reason string)
+	Unban(p netip.Prefix) int
+	List() []BlockEntry
 	Reset()
+	Len() int
 }
 
 type Bucket interface {
-	GetToken() bool
+	GetToken(key string) bool
+	RetryAfter(key string) time.Duration
+	Quota(key string) Quota
+	// Take is GetToken returning quota left after it, in one step for shared buckets
+	Take(key string) (bool, Quota)
 }
@@ -1,58 +1,340 @@
 package lib
 
 import (
+	"container/list"
+	"context"
+	"log/slog"
+	"net/netip"
+	"slices"
 	"sync"
 	"time"
 )
 
+// JailPolicy escalates ban durations for repeated offences, offences older than Memory are forgotten
+type JailPolicy struct {
+	Durations []time.Duration
+	Memory    time.Duration
+}
+
+func (j JailPolicy) duration(offences int) time.Duration {
+	if len(j.Durations) == 0 {
+		return 0
+	}
+	return j.Durations[min(offences, len(j.Durations))-1]
+}
+
 type blockRecord struct {
-	counter int
+	ip      string
+	el      *list.Element
+	counter float64
 	lastAcc time.Time
+
+	offences int
+	bannedAt time.Time
+	until    time.Time
+	reason   string
+}
+
+func (x *blockRecord) entry() BlockEntry {
+	return BlockEntry{
+		IP:       x.ip,
+		Strikes:  x.counter,
+		LastFail: x.lastAcc,
+		Offences: x.offences,
+		BannedAt: x.bannedAt,
+		Until:    x.until,
+		Reason:   x.reason,
+	}
+}
+
+func (x *blockRecord) banned(now time.Time) bool {
+	return now.Before(x.until)
+}
+
+// expired reports if record carries no information anymore: not banned, strikes reset
+// and offences forgotten
+func (x *blockRecord) expired(now time.Time, resetDur, memory time.Duration) bool {
+	if x.banned(now) || now.Sub(x.lastAcc) <= resetDur {
+		return false
+	}
+	return x.offences == 0 || (memory > 0 && now.Sub(x.bannedAt) > memory)
 }
 
+const lruEvictScan = 64
+
 type IPBlocker struct {
-	limit    int
-	resetDur time.Duration
+	limit      int
+	resetDur   time.Duration
+	jail       JailPolicy
+	maxTracked int
 
-	ac map[string]*blockRecord
-	mu sync.RWMutex
+	ac  map[string]*blockRecord
+	lru *list.List
+	mu  sync.RWMutex
 }
 
-func NewIPBlocker(limit int, resetDur time.Duration) *IPBlocker {
+// NewIPBlocker creates blocker which bans ip once its strikes within resetDur exceed limit,
+// without jail durations ban lasts resetDur. At most maxTracked ips are kept, least recently
+// failing ones are evicted first, bans expiring soonest only when blocker is full of bans, zero
+// means unlimited.
+func NewIPBlocker(limit int, resetDur time.Duration, jail JailPolicy, maxTracked int) *IPBlocker {
+	if len(jail.Durations) == 0 {
+		jail.Durations = []time.Duration{resetDur}
+	}
 	tb := &IPBlocker{
-		limit:    limit,
-		resetDur: resetDur,
-		ac:       make(map[string]*blockRecord, 3),
+		limit:      limit,
+		resetDur:   resetDur,
+		jail:       jail,
+		maxTracked: maxTracked,
+		ac:         make(map[string]*blockRecord, 3),
+		lru:        list.New(),
 	}
 	return tb
 }
 
-func (b *IPBlocker) NotifyFailure(ip string) {
+// Run sweeps expired records every interval until ctx is done
+func (b *IPBlocker) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			b.sweep()
+		}
+	}
+}
+
+func (b *IPBlocker) sweep() {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	x, ok := b.ac[ip]
-	if !ok {
-		b.ac[ip] = &blockRecord{counter: 1, lastAcc: time.Now()}
-		return
+	now := time.Now()
+	for _, x := range b.ac {
+		if x.expired(now, b.resetDur, b.jail.Memory) {
+			b.remove(x)
+		}
 	}
+}
+
+func (b *IPBlocker) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.ac)
+}
+
+// record returns record of ip marked as most recently used, creating it if there is room. Making
+// room for a ban evicts other ban when nothing else can go. Caller must hold mu.
+func (b *IPBlocker) record(ip string, ban bool) *blockRecord {
+	if x, ok := b.ac[ip]; ok {
+		b.lru.MoveToFront(x.el)
+		return x
+	}
+	if b.maxTracked > 0 && len(b.ac) >= b.maxTracked && !b.evict(ban) {
+		slog.Debug("ip blocker full, not tracking", lIP, ip)
+		return nil
+	}
+
+	x := &blockRecord{ip: ip}
+	x.el = b.lru.PushFront(x)
+	b.ac[ip] = x
+	return x
+}
 
-	if time.Since(x.lastAcc) > b.resetDur {
-		x.counter = 1
+// evict drops least recently used record which is not banned, if all scanned records are banned
+// and bans is set, the one expiring soonest is dropped. Caller must hold mu.
+func (b *IPBlocker) evict(bans bool) bool {
+	now := time.Now()
+	var soonest *blockRecord
+	for range min(lruEvictScan, b.lru.Len()) {
+		el := b.lru.Back()
+		x, _ := el.Value.(*blockRecord)
+		if !x.banned(now) {
+			b.remove(x)
+			return true
+		}
+		if soonest == nil || x.until.Before(soonest.until) {
+			soonest = x
+		}
+		b.lru.MoveToFront(el)
+	}
+	if !bans || soonest == nil {
+		return false
+	}
+	slog.Warn("ip blocker full of bans, dropping one expiring soonest", lIP, soonest.ip, "until", soonest.until)
+	b.remove(soonest)
+	return true
+}
+
+func (b *IPBlocker) remove(x *blockRecord) {
+	b.lru.Remove(x.el)
+	delete(b.ac, x.ip)
+}
+
+func (b *IPBlocker) NotifyFailure(ip string, weight float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	x := b.record(ip, false)
+	// retries during ban don't extend it
+	if x == nil || x.banned(now) {
+		return 0
+	}
+
+	if now.Sub(x.lastAcc) > b.resetDur {
+		x.counter = weight
 	} else {
-		x.counter++
+		x.counter += weight
+	}
+	x.lastAcc = now
+
+	if x.counter <= float64(b.limit) {
+		return 0
 	}
-	x.lastAcc = time.Now()
+	b.ban(ip, x, now, 0, "strike limit")
+	return x.until.Sub(now)
+}
+
+// Ban blocks ip immediately for d, zero d escalates by jail policy, counts as an offence
+func (b *IPBlocker) Ban(ip string, d time.Duration, reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// blocker full of bans gives up the one expiring soonest, so it never grows over its cap
+	x := b.record(ip, true)
+	if x == nil {
+		return
+	}
+	b.ban(ip, x, time.Now(), d, reason)
+}
+
+// ban puts record to jail for d or escalated duration if d is zero, caller must hold mu
+func (b *IPBlocker) ban(ip string, x *blockRecord, now time.Time, d time.Duration, reason string) {
+	if b.jail.Memory > 0 && now.Sub(x.bannedAt) > b.jail.Memory {
+		x.offences = 0
+	}
+	x.offences++
+	x.counter = 0
+	x.bannedAt = now
+	if d <= 0 {
+		d = b.jail.duration(x.offences)
+	}
+	x.until = now.Add(d)
+	x.reason = reason
+
+	slog.Warn("ip banned", lIP, ip, "reason", reason, "offences", x.offences, "until", x.until)
 }
 
 func (b *IPBlocker) CheckBlocked(ip string) bool {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	x, ok := b.ac[ip]
-	return ok && x.counter > b.limit
+	return ok && x.banned(time.Now())
+}
+
+// BannedFor returns how long ip stays blocked
+func (b *IPBlocker) BannedFor(ip string) time.Duration {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	x, ok := b.ac[ip]
+	if !ok {
+		return 0
+	}
+	return max(time.Until(x.until), 0)
+}
+
+// Snapshot returns records worth keeping across restarts, ips with ban history
+func (b *IPBlocker) Snapshot() []BlockEntry {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	entries := make([]BlockEntry, 0, len(b.ac))
+	for _, x := range b.ac {
+		if x.offences == 0 {
+			continue
+		}
+		entries = append(entries, x.entry())
+	}
+	return entries
+}
+
+// List returns all tracked records
+func (b *IPBlocker) List() []BlockEntry {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	entries := make([]BlockEntry, 0, len(b.ac))
+	for _, x := range b.ac {
+		entries = append(entries, x.entry())
+	}
+	return entries
 }
+
+// Unban forgets records of all ips and client prefixes overlapping p, returns number of removed records
+func (b *IPBlocker) Unban(p netip.Prefix) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+	for ip, x := range b.ac {
+		// records may be keyed by client prefix
+		if key, err := ParsePrefix(ip); err == nil && p.Overlaps(key) {
+			b.remove(x)
+			n++
+		}
+	}
+	if n > 0 {
+		slog.Warn("ip unbanned", lIP, p.String(), "records", n)
+	}
+	return n
+}
+
+// Restore loads entries, skipping expired ones, returns number of restored entries. Over maxTracked
+// bans are restored first.
+func (b *IPBlocker) Restore(entries []BlockEntry) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.maxTracked > 0 && len(b.ac)+len(entries) > b.maxTracked {
+		entries = slices.Clone(entries)
+		slices.SortFunc(entries, byPriority(now))
+	}
+	n := 0
+	for _, e := range entries {
+		x := &blockRecord{
+			ip:       e.IP,
+			counter:  e.Strikes,
+			lastAcc:  e.LastFail,
+			offences: e.Offences,
+			bannedAt: e.BannedAt,
+			until:    e.Until,
+			reason:   e.Reason,
+		}
+		if x.expired(now, b.resetDur, b.jail.Memory) {
+			continue
+		}
+		if old, ok := b.ac[e.IP]; ok {
+			b.remove(old)
+		} else if b.maxTracked > 0 && len(b.ac) >= b.maxTracked {
+			continue
+		}
+		// entries come in priority order, the least important end up least recently used
+		x.el = b.lru.PushBack(x)
+		b.ac[e.IP] = x
+		n++
+	}
+	return n
+}
+
 func (b *IPBlocker) Reset() {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	clear(b.ac)
+	b.lru.Init()
 }
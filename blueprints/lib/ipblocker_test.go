@@ -0,0 +1,87 @@
+package lib_test
+
+import (
+	"fmt"
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"testing"
+	"time"
+)
+
+func TestIPBlockerEscalation(t *testing.T) {
+	jail := lib.JailPolicy{Durations: []time.Duration{50 * time.Millisecond, 150 * time.Millisecond}, Memory: time.Hour}
+	b := lib.NewIPBlocker(2, time.Hour, jail, 0)
+	ip := "198.51.100.1"
+
+	strike := func() {
+		for range 3 {
+			b.NotifyFailure(ip, 1)
+		}
+	}
+
+	strike()
+	if !b.CheckBlocked(ip) {
+		t.Fatal("ip not banned after exceeding limit")
+	}
+	if d := b.BannedFor(ip); d <= 0 || d > 50*time.Millisecond {
+		t.Errorf("first ban lasts %v", d)
+	}
+
+	// retries while banned must not extend the ban
+	for range 10 {
+		b.NotifyFailure(ip, 1)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if b.CheckBlocked(ip) {
+		t.Fatal("ban extended by retries")
+	}
+
+	strike()
+	if d := b.BannedFor(ip); d <= 50*time.Millisecond {
+		t.Errorf("second ban not escalated: %v", d)
+	}
+
+	b.Ban("198.51.100.2", 0, "manual")
+	if !b.CheckBlocked("198.51.100.2") || b.CheckBlocked("198.51.100.3") {
+		t.Error("manual ban applied to wrong ip")
+	}
+}
+
+func TestIPBlockerBounded(t *testing.T) {
+	b := lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{}, 3)
+
+	b.Ban("10.0.0.1", 0, "test")
+	b.Ban("10.0.0.2", 0, "test")
+	for _, ip := range []string{"10.0.1.1", "10.0.1.2", "10.0.1.3", "10.0.1.4"} {
+		b.NotifyFailure(ip, 1)
+	}
+	if n := b.Len(); n != 3 {
+		t.Errorf("tracking %d ips, expected cap 3", n)
+	}
+	if !b.CheckBlocked("10.0.0.1") || !b.CheckBlocked("10.0.0.2") {
+		t.Error("active ban evicted")
+	}
+
+	b.NotifyFailure("10.0.1.4", 1)
+	if !b.CheckBlocked("10.0.1.4") {
+		t.Error("most recent ip was evicted")
+	}
+}
+
+func TestIPBlockerBoundedBans(t *testing.T) {
+	b := lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{}, 4)
+
+	// scanner rotating client prefixes, e.g. /64s of one /48, must not grow blocker over its cap
+	b.Ban("2001:db8::/64", 2*time.Hour, "manual")
+	for i := range 20 {
+		b.Ban(fmt.Sprintf("2001:db8:0:%x::/64", i+1), time.Hour+time.Duration(i)*time.Second, "inspection")
+		if n := b.Len(); n > 4 {
+			t.Fatalf("tracking %d ips, expected cap 4", n)
+		}
+	}
+	if !b.CheckBlocked("2001:db8:0:14::/64") {
+		t.Error("latest ban dropped")
+	}
+	if !b.CheckBlocked("2001:db8::/64") {
+		t.Error("longest ban dropped before shorter ones")
+	}
+}
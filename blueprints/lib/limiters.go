@@ -0,0 +1,455 @@
+package lib
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limiting algorithms
+const (
+	AlgoTokenBucket   = "token_bucket"
+	AlgoLeakyBucket   = "leaky_bucket"
+	AlgoFixedWindow   = "fixed_window"
+	AlgoSlidingLog    = "sliding_log"
+	AlgoSlidingWindow = "sliding_window"
+)
+
+var ErrLimit = errors.New("invalid limit")
+
+// LimitPolicy selects algorithm allowing Limit requests per Window. Token and leaky buckets hold
+// Limit requests and refill or drain at Limit per Window.
+type LimitPolicy struct {
+	Algorithm string
+	Limit     int
+	Window    time.Duration
+}
+
+// ParseLimitPolicy parses "<algorithm>:<limit>/<window>", window is a duration or bare unit,
+// e.g. "sliding_window:100/1h", "token_bucket:10/5s" or "fixed_window:60/min"
+func ParseLimitPolicy(spec string) (*LimitPolicy, error) {
+	algo, quota, ok := strings.Cut(strings.TrimSpace(spec), ":")
+	n, window, ok2 := strings.Cut(quota, "/")
+	if !ok || !ok2 {
+		return nil, errors.Join(ErrLimit, errors.New(spec))
+	}
+
+	p := &LimitPolicy{Algorithm: algo}
+	switch algo {
+	case AlgoTokenBucket, AlgoLeakyBucket, AlgoFixedWindow, AlgoSlidingLog, AlgoSlidingWindow:
+	default:
+		return nil, errors.Join(ErrLimit, errors.New("unknown algorithm "+algo))
+	}
+
+	var err error
+	if p.Limit, err = strconv.Atoi(n); err != nil || p.Limit <= 0 {
+		return nil, errors.Join(ErrLimit, errors.New("limit must be positive: "+n))
+	}
+	if window == "min" {
+		window = "m"
+	}
+	if window != "" && (window[0] < '0' || window[0] > '9') {
+		window = "1" + window
+	}
+	if p.Window, err = time.ParseDuration(window); err != nil || p.Window <= 0 {
+		return nil, errors.Join(ErrLimit, errors.New("window must be positive: "+window))
+	}
+	return p, nil
+}
+
+func (p *LimitPolicy) String() string {
+	return p.Algorithm + ":" + strconv.Itoa(p.Limit) + "/" + p.Window.String()
+}
+
+// Rate returns average rate allowed by policy
+func (p *LimitPolicy) Rate() Rate {
+	return Rate(float64(p.Limit) / p.Window.Seconds())
+}
+
+// New creates bucket of single client
+func (p *LimitPolicy) New() Bucket {
+	switch p.Algorithm {
+	case AlgoLeakyBucket:
+		return NewLeakyBucket(p.Limit, p.Rate(), nil)
+	case AlgoFixedWindow:
+		return NewFixedWindow(p.Limit, p.Window, nil)
+	case AlgoSlidingLog:
+		return NewSlidingLog(p.Limit, p.Window, nil)
+	case AlgoSlidingWindow:
+		return NewSlidingWindow(p.Limit, p.Window, nil)
+	}
+	return NewGCRA(p.Rate(), p.Limit, nil)
+}
+
+// LeakyBucket is leaky bucket as a meter: each request pours one unit in, bucket drains at rate
+// and requests overflowing capacity are rejected
+type LeakyBucket struct {
+	capacity float64
+	rate     float64
+	clock    Clock
+
+	level float64
+	last  time.Time
+	mu    sync.Mutex
+}
+
+func NewLeakyBucket(capacity int, rate Rate, clock Clock) *LeakyBucket {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &LeakyBucket{capacity: float64(capacity), rate: float64(rate), clock: clock}
+}
+
+// drain lowers level by what leaked since last call, caller must hold mu
+func (b *LeakyBucket) drain(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.level = max(b.level-elapsed*b.rate, 0)
+		b.last = now
+	}
+}
+
+func (b *LeakyBucket) GetToken(_ string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.take(b.clock())
+}
+
+func (b *LeakyBucket) Take(_ string) (bool, Quota) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock()
+	ok := b.take(now)
+	return ok, b.quota(now)
+}
+
+func (b *LeakyBucket) take(now time.Time) bool {
+	b.drain(now)
+	if b.level+1 > b.capacity {
+		return false
+	}
+	b.level++
+	return true
+}
+
+// RetryAfter returns time until one more request fits, zero if it fits now
+func (b *LeakyBucket) RetryAfter(_ string) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.retryAfter(b.clock())
+}
+
+func (b *LeakyBucket) retryAfter(now time.Time) time.Duration {
+	b.drain(now)
+	over := b.level + 1 - b.capacity
+	if over <= 0 {
+		return 0
+	}
+	return Rate(b.rate).Duration(over)
+}
+
+func (b *LeakyBucket) Quota(_ string) Quota {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.quota(b.clock())
+}
+
+func (b *LeakyBucket) quota(now time.Time) Quota {
+	b.drain(now)
+	return Quota{
+		Limit:      int(b.capacity),
+		Window:     Rate(b.rate).Duration(b.capacity),
+		Remaining:  int(b.capacity - b.level),
+		Reset:      Rate(b.rate).Duration(b.level),
+		RetryAfter: b.retryAfter(now),
+	}
+}
+
+// FixedWindow counts requests in windows aligned to multiples of window since zero time
+type FixedWindow struct {
+	limit  int
+	window time.Duration
+	clock  Clock
+
+	start time.Time
+	count int
+	mu    sync.Mutex
+}
+
+func NewFixedWindow(limit int, window time.Duration, clock Clock) *FixedWindow {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &FixedWindow{limit: limit, window: window, clock: clock}
+}
+
+// roll starts window containing now, caller must hold mu
+func (w *FixedWindow) roll(now time.Time) {
+	if start := now.Truncate(w.window); !start.Equal(w.start) {
+		w.start, w.count = start, 0
+	}
+}
+
+func (w *FixedWindow) GetToken(_ string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.take(w.clock())
+}
+
+func (w *FixedWindow) Take(_ string) (bool, Quota) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.clock()
+	ok := w.take(now)
+	return ok, w.quota(now)
+}
+
+func (w *FixedWindow) take(now time.Time) bool {
+	w.roll(now)
+	if w.count >= w.limit {
+		return false
+	}
+	w.count++
+	return true
+}
+
+// RetryAfter returns time until window resets, zero if request is allowed now
+func (w *FixedWindow) RetryAfter(_ string) time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.retryAfter(w.clock())
+}
+
+func (w *FixedWindow) retryAfter(now time.Time) time.Duration {
+	w.roll(now)
+	if w.count < w.limit {
+		return 0
+	}
+	return w.start.Add(w.window).Sub(now)
+}
+
+func (w *FixedWindow) Quota(_ string) Quota {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.quota(w.clock())
+}
+
+func (w *FixedWindow) quota(now time.Time) Quota {
+	w.roll(now)
+	q := Quota{Limit: w.limit, Window: w.window, Remaining: w.limit - w.count, RetryAfter: w.retryAfter(now)}
+	if w.count > 0 {
+		q.Reset = w.start.Add(w.window).Sub(now)
+	}
+	return q
+}
+
+// SlidingLog keeps timestamps of allowed requests within the last window, exact but holding up to
+// limit timestamps per client
+type SlidingLog struct {
+	limit  int
+	window time.Duration
+	clock  Clock
+
+	// log is ring buffer of timestamps grown on demand up to limit, head is the oldest
+	log  []time.Time
+	head int
+	n    int
+	mu   sync.Mutex
+}
+
+func NewSlidingLog(limit int, window time.Duration, clock Clock) *SlidingLog {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &SlidingLog{limit: max(limit, 0), window: window, clock: clock}
+}
+
+// evict forgets requests which left the window, caller must hold mu
+func (l *SlidingLog) evict(now time.Time) {
+	for l.n > 0 && !now.Before(l.log[l.head].Add(l.window)) {
+		l.head = (l.head + 1) % len(l.log)
+		l.n--
+	}
+}
+
+// grow doubles full ring buffer, at most to limit, caller must hold mu
+func (l *SlidingLog) grow() {
+	log := make([]time.Time, min(max(2*len(l.log), 4), l.limit))
+	copy(log, l.log[l.head:])
+	copy(log[len(l.log)-l.head:], l.log[:l.head])
+	l.log, l.head = log, 0
+}
+
+func (l *SlidingLog) GetToken(_ string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.take(l.clock())
+}
+
+func (l *SlidingLog) Take(_ string) (bool, Quota) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock()
+	ok := l.take(now)
+	return ok, l.quota(now)
+}
+
+func (l *SlidingLog) take(now time.Time) bool {
+	l.evict(now)
+	if l.n >= l.limit {
+		return false
+	}
+	if l.n == len(l.log) {
+		l.grow()
+	}
+	l.log[(l.head+l.n)%len(l.log)] = now
+	l.n++
+	return true
+}
+
+// RetryAfter returns time until the oldest logged request leaves the window, zero if request is
+// allowed now
+func (l *SlidingLog) RetryAfter(_ string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.retryAfter(l.clock())
+}
+
+func (l *SlidingLog) retryAfter(now time.Time) time.Duration {
+	l.evict(now)
+	if l.n < l.limit {
+		return 0
+	}
+	if l.n == 0 {
+		return math.MaxInt64
+	}
+	return l.log[l.head].Add(l.window).Sub(now)
+}
+
+// Quota resets once the newest logged request leaves the window
+func (l *SlidingLog) Quota(_ string) Quota {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.quota(l.clock())
+}
+
+func (l *SlidingLog) quota(now time.Time) Quota {
+	l.evict(now)
+	q := Quota{Limit: l.limit, Window: l.window, Remaining: l.limit - l.n, RetryAfter: l.retryAfter(now)}
+	if l.n > 0 {
+		q.Reset = l.log[(l.head+l.n-1)%len(l.log)].Add(l.window).Sub(now)
+	}
+	return q
+}
+
+// SlidingWindow approximates sliding log with counts of current and previous fixed window, the
+// previous one weighted by how much of it still overlaps the sliding window
+type SlidingWindow struct {
+	limit  float64
+	window time.Duration
+	clock  Clock
+
+	start time.Time
+	prev  float64
+	cur   float64
+	mu    sync.Mutex
+}
+
+func NewSlidingWindow(limit int, window time.Duration, clock Clock) *SlidingWindow {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &SlidingWindow{limit: float64(limit), window: window, clock: clock}
+}
+
+// roll moves to window containing now and returns elapsed part of it, caller must hold mu
+func (w *SlidingWindow) roll(now time.Time) float64 {
+	start := now.Truncate(w.window)
+	switch {
+	case start.Equal(w.start):
+	case start.Equal(w.start.Add(w.window)):
+		w.prev, w.cur, w.start = w.cur, 0, start
+	default:
+		w.prev, w.cur, w.start = 0, 0, start
+	}
+	return float64(now.Sub(start)) / float64(w.window)
+}
+
+func (w *SlidingWindow) GetToken(_ string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.take(w.clock())
+}
+
+func (w *SlidingWindow) Take(_ string) (bool, Quota) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.clock()
+	ok := w.take(now)
+	return ok, w.quota(now)
+}
+
+func (w *SlidingWindow) take(now time.Time) bool {
+	elapsed := w.roll(now)
+	if w.prev*(1-elapsed)+w.cur+1 > w.limit {
+		return false
+	}
+	w.cur++
+	return true
+}
+
+// RetryAfter returns time until weighted count drops enough for one more request, zero if request
+// is allowed now
+func (w *SlidingWindow) RetryAfter(_ string) time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.retryAfter(w.clock())
+}
+
+func (w *SlidingWindow) retryAfter(now time.Time) time.Duration {
+	elapsed := w.roll(now)
+	room := w.limit - 1 - w.cur
+	if w.prev*(1-elapsed) <= room {
+		return 0
+	}
+	window := float64(w.window)
+	if room >= 0 {
+		// previous window weight has to fall to room
+		return time.Duration(math.Ceil(((1 - room/w.prev) - elapsed) * window))
+	}
+	if w.cur <= 0 || w.limit < 1 {
+		return math.MaxInt64
+	}
+	// after current window ends it becomes the previous one
+	return time.Duration(math.Ceil((1 - elapsed + 1 - (w.limit-1)/w.cur) * window))
+}
+
+// Quota resets once both counted windows stop overlapping the sliding one
+func (w *SlidingWindow) Quota(_ string) Quota {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.quota(w.clock())
+}
+
+func (w *SlidingWindow) quota(now time.Time) Quota {
+	elapsed := w.roll(now)
+	q := Quota{
+		Limit:      int(w.limit),
+		Window:     w.window,
+		Remaining:  int(max(w.limit-w.prev*(1-elapsed)-w.cur, 0)),
+		RetryAfter: w.retryAfter(now),
+	}
+	switch {
+	case w.cur > 0:
+		q.Reset = time.Duration(math.Ceil((2 - elapsed) * float64(w.window)))
+	case w.prev > 0:
+		q.Reset = time.Duration(math.Ceil((1 - elapsed) * float64(w.window)))
+	}
+	return q
+}
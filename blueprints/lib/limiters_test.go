@@ -0,0 +1,325 @@
+package lib_test
+
+import (
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLimitPolicy(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{"sliding_window:100/1h", "sliding_window:100/1h0m0s", false},
+		{"token_bucket:10/5s", "token_bucket:10/5s", false},
+		{"fixed_window:60/min", "fixed_window:60/1m0s", false},
+		{"leaky_bucket:5/s", "leaky_bucket:5/1s", false},
+		{"sliding_log:3/h", "sliding_log:3/1h0m0s", false},
+		{"token_bucket:10", "", true},
+		{"gcra:10/s", "", true},
+		{"fixed_window:0/s", "", true},
+		{"fixed_window:1/-1s", "", true},
+	}
+	for _, tt := range tests {
+		p, err := lib.ParseLimitPolicy(tt.in)
+		if (err != nil) != tt.err || (err == nil && p.String() != tt.want) {
+			t.Errorf("ParseLimitPolicy(%q) got %v, %v", tt.in, p, err)
+		}
+	}
+}
+
+func newLimiter(algo string, limit int, window time.Duration, clock lib.Clock) lib.Bucket {
+	rate := lib.Rate(float64(limit) / window.Seconds())
+	switch algo {
+	case lib.AlgoLeakyBucket:
+		return lib.NewLeakyBucket(limit, rate, clock)
+	case lib.AlgoFixedWindow:
+		return lib.NewFixedWindow(limit, window, clock)
+	case lib.AlgoSlidingLog:
+		return lib.NewSlidingLog(limit, window, clock)
+	case lib.AlgoSlidingWindow:
+		return lib.NewSlidingWindow(limit, window, clock)
+	}
+	return lib.NewGCRA(rate, limit, clock)
+}
+
+// drain takes all available tokens, returns their number
+func drain(b lib.Bucket) int {
+	n := 0
+	for b.GetToken("") {
+		n++
+	}
+	return n
+}
+
+var algorithms = []string{
+	lib.AlgoTokenBucket, lib.AlgoLeakyBucket, lib.AlgoFixedWindow, lib.AlgoSlidingLog, lib.AlgoSlidingWindow,
+}
+
+// TestLimiters checks contract shared by all algorithms: limit requests pass at once, the next one
+// is rejected until RetryAfter elapses
+func TestLimiters(t *testing.T) {
+	for _, algo := range algorithms {
+		t.Run(algo, func(t *testing.T) {
+			clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+			b := newLimiter(algo, 5, time.Minute, clock.Now)
+
+			for round := range 3 {
+				for i := range 5 {
+					if round == 0 && !b.GetToken("") {
+						t.Fatalf("request %d of fresh limiter rejected", i)
+					}
+				}
+				if b.GetToken("") {
+					t.Fatalf("round %d: request over limit allowed", round)
+				}
+				retry := b.RetryAfter("")
+				if retry <= 0 || retry > time.Minute {
+					t.Fatalf("round %d: retry after %v", round, retry)
+				}
+				clock.Advance(retry - time.Millisecond)
+				if b.GetToken("") {
+					t.Fatalf("round %d: allowed %v before retry after", round, time.Millisecond)
+				}
+				clock.Advance(time.Millisecond)
+				if b.RetryAfter("") != 0 || !b.GetToken("") {
+					t.Fatalf("round %d: rejected after retry after", round)
+				}
+				// drain whatever refilled meanwhile
+				drain(b)
+			}
+		})
+	}
+}
+
+func TestLimiterShapes(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0).Truncate(time.Minute)
+
+	// fixed window lets two windows worth through around the boundary, sliding ones don't
+	tests := []struct {
+		algo string
+		want int
+	}{
+		{lib.AlgoFixedWindow, 20},
+		{lib.AlgoSlidingLog, 10},
+		{lib.AlgoSlidingWindow, 10},
+	}
+	for _, tt := range tests {
+		clock := &fakeClock{now: start.Add(59 * time.Second)}
+		b := newLimiter(tt.algo, 10, time.Minute, clock.Now)
+		n := drain(b)
+		clock.Advance(time.Second)
+		if n += drain(b); n != tt.want {
+			t.Errorf("%s allowed %d around window boundary", tt.algo, n)
+		}
+	}
+
+	// sliding window weights previous window by its overlap
+	clock := &fakeClock{now: start}
+	b := lib.NewSlidingWindow(10, time.Minute, clock.Now)
+	drain(b)
+	clock.Advance(90 * time.Second)
+	if n := drain(b); n != 5 {
+		t.Errorf("sliding window allowed %d with half of previous window overlapping", n)
+	}
+}
+
+// TestSlidingLogGrowth checks log grows with requests instead of holding limit timestamps upfront
+func TestSlidingLogGrowth(t *testing.T) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	l := lib.NewSlidingLog(1_000_000, time.Hour, nil)
+	l.GetToken("")
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<16 {
+		t.Errorf("log of single request allocated %d bytes", n)
+	}
+
+	// ring wraps before growing, order of requests has to survive
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+	l = lib.NewSlidingLog(10, time.Minute, clock.Now)
+	for range 3 {
+		l.GetToken("")
+	}
+	clock.Advance(time.Minute)
+	l.GetToken("")
+	l.GetToken("")
+	for range 10 {
+		clock.Advance(time.Second)
+		l.GetToken("")
+	}
+	clock.Advance(time.Minute - 5*time.Second)
+	if n := drain(l); n != 7 || l.RetryAfter("") != time.Second {
+		t.Errorf("allowed %d after seven requests left window, retry after %v", n, l.RetryAfter(""))
+	}
+}
+
+func TestRouteLimit(t *testing.T) {
+	vars := &lib.EnvVars{BucketLimit: 100, BucketRate: 10, BucketIdle: time.Minute, RateLimitStatus: 429}
+	backend := echoServer("backend")
+	defer backend.Close()
+	targets, _ := lib.ParseTargets(backend.URL)
+
+	rules, err := lib.ParseRules("/share limit=sliding_log:2/1h "+backend.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := lib.NewRouteTable()
+	_ = routes.Add("example.com", rules...)
+	_ = routes.Add("example.com", &lib.Route{Prefix: "/", Pool: lib.NewPool("", targets)})
+	// route window outlives idle buckets
+	routes.InitLimits(time.Nanosecond, nil)
+	handler := lib.InitServer(lib.NewIPBlocker(100, time.Hour, lib.JailPolicy{}, 0), lib.NewBucket(vars), vars,
+		testMetrics(), routes, nil, nil).Handler
+
+	get := func(path string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if code := get("/share/abc"); code != want {
+			t.Errorf("share request %d got %d", i, code)
+		}
+	}
+	if code := get("/"); code != http.StatusOK {
+		t.Errorf("default route got %d", code)
+	}
+}
+
+// BenchmarkLimiters compares algorithms on single bucket shared by all goroutines and on per client
+// buckets, ns/op is cpu cost under contention, B/bucket is memory held by one client
+func BenchmarkLimiters(b *testing.B) {
+	for _, algo := range algorithms {
+		policy := &lib.LimitPolicy{Algorithm: algo, Limit: 100, Window: time.Minute}
+
+		b.Run(algo+"/shared", func(b *testing.B) {
+			bucket := policy.New()
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					bucket.GetToken("")
+				}
+			})
+		})
+
+		b.Run(algo+"/clients", func(b *testing.B) {
+			buckets := lib.NewClientBuckets(policy.New, time.Minute, nil, nil)
+			keys := make([]string, 1024)
+			for i := range keys {
+				keys[i] = "198.51." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256)
+			}
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					buckets.GetToken(keys[i%len(keys)])
+					i++
+				}
+			})
+		})
+
+		b.Run(algo+"/memory", func(b *testing.B) {
+			var before, after runtime.MemStats
+			buckets := make([]lib.Bucket, 1000)
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			for i := range buckets {
+				buckets[i] = policy.New()
+				drain(buckets[i])
+			}
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			for b.Loop() {
+				buckets[0].GetToken("")
+			}
+			b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(len(buckets)), "B/bucket")
+			runtime.KeepAlive(buckets)
+		})
+	}
+}
+
+func TestQuota(t *testing.T) {
+	for _, algo := range algorithms {
+		t.Run(algo, func(t *testing.T) {
+			clock := &fakeClock{now: time.Unix(1_700_000_000, 0).Truncate(time.Minute)}
+			b := newLimiter(algo, 5, time.Minute, clock.Now)
+
+			if q := b.Quota(""); q.Limit != 5 || q.Window != time.Minute || q.Remaining != 5 || q.Reset != 0 {
+				t.Errorf("fresh quota %+v", q)
+			}
+			b.GetToken("")
+			b.GetToken("")
+			clock.Advance(time.Second)
+			if q := b.Quota(""); q.Remaining != 3 || q.Reset <= 0 || q.Reset > 2*time.Minute {
+				t.Errorf("quota after two requests %+v", q)
+			}
+			if ok, q := b.Take(""); !ok || q != b.Quota("") || q.Remaining != 2 || q.RetryAfter != 0 {
+				t.Errorf("quota of taken token %+v", q)
+			}
+			drain(b)
+			if ok, q := b.Take(""); ok || q.Remaining != 0 || q.RetryAfter <= 0 || q.RetryAfter != b.RetryAfter("") {
+				t.Errorf("quota of rejected request %+v", q)
+			}
+			clock.Advance(3 * time.Minute)
+			if q := b.Quota(""); q.Remaining != 5 || q.Reset != 0 {
+				t.Errorf("quota after idle %+v", q)
+			}
+		})
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	vars := &lib.EnvVars{BucketLimit: 2, BucketRate: 1, BucketIdle: time.Minute, RateLimitStatus: 429}
+	backend := echoServer("backend")
+	defer backend.Close()
+
+	rules, _ := lib.ParseRules(`/share limit=fixed_window:10/1h `+backend.URL, "")
+	routes := lib.NewRouteTable()
+	_ = routes.Add("example.com", rules...)
+	targets, _ := lib.ParseTargets(backend.URL)
+	_ = routes.Add("example.com", &lib.Route{Prefix: "/", Pool: lib.NewPool("", targets)})
+	routes.InitLimits(time.Minute, nil)
+	handler := lib.InitServer(lib.NewIPBlocker(100, time.Hour, lib.JailPolicy{}, 0), lib.NewBucket(vars), vars,
+		testMetrics(), routes, nil, nil).Handler
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/")
+	if p := rec.Header().Get("RateLimit-Policy"); p != `"default";q=2;w=2` {
+		t.Errorf("policy %q", p)
+	}
+	if l := rec.Header().Get("RateLimit"); l != `"default";r=1;t=1` {
+		t.Errorf("limit %q", l)
+	}
+
+	rec = get("/share/x")
+	if p := rec.Header().Get("RateLimit-Policy"); p != `"example.com/share";q=10;w=3600` {
+		t.Errorf("route policy %q", p)
+	}
+	if l := rec.Header().Get("RateLimit"); !strings.HasPrefix(l, `"example.com/share";r=9;t=`) {
+		t.Errorf("route limit %q", l)
+	}
+
+	get("/")
+	rec = get("/")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" ||
+		rec.Header().Get("RateLimit") != `"default";r=0;t=2` {
+		t.Errorf("rate limited got %d %v", rec.Code, rec.Header())
+	}
+}
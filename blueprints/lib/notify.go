@@ -0,0 +1,364 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Notification sinks
+const (
+	SinkWebhook       = "webhook"
+	SinkNtfy          = "ntfy"
+	SinkHomeAssistant = "homeassistant"
+	SinkAlertmanager  = "alertmanager"
+
+	notifyQueue   = 1024
+	notifyBackoff = time.Second
+)
+
+var (
+	ErrNotify = errors.New("invalid notifier")
+	// errRejected marks responses retrying won't fix
+	errRejected = errors.New("notification rejected")
+)
+
+// Sink delivers batch of events to external service
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, events []Event) error
+}
+
+// Notifier batches events for its sink: first event waits Batch for others to join, sends are at
+// least Interval apart and carry at most MaxBatch events. Failed sends are retried Retries times
+// with doubling Backoff, events not fitting the queue meanwhile are dropped.
+type Notifier struct {
+	Sink     Sink
+	Events   []string
+	Batch    time.Duration
+	Interval time.Duration
+	MaxBatch int
+	Retries  int
+	Backoff  time.Duration
+
+	queue   chan Event
+	dropped atomic.Int64
+}
+
+// NewNotifier creates notifier of all event kinds
+func NewNotifier(sink Sink, batch, interval time.Duration) *Notifier {
+	return &Notifier{
+		Sink:     sink,
+		Batch:    batch,
+		Interval: interval,
+		MaxBatch: 50,
+		Retries:  3,
+		Backoff:  notifyBackoff,
+		queue:    make(chan Event, notifyQueue),
+	}
+}
+
+// ParseNotifiers parses ';' separated sinks in form
+// "<webhook|ntfy|homeassistant|alertmanager> <url> [events=ban,unban,storm] [token_env=VAR]
+// [batch=10s] [interval=30s]", token is sent as bearer token, batching defaults come from vars
+func ParseNotifiers(spec string, vars *EnvVars) ([]*Notifier, error) {
+	var notifiers []*Notifier
+	for rule := range strings.SplitSeq(spec, ";") {
+		f := strings.Fields(rule)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) < 2 {
+			return nil, errors.Join(ErrNotify, errors.New(rule))
+		}
+
+		var events []string
+		token := ""
+		batch, interval := vars.NotifyBatch, vars.NotifyInterval
+		for _, opt := range f[2:] {
+			k, v, _ := strings.Cut(opt, "=")
+			var err error
+			switch k {
+			case "events":
+				events = strings.Split(v, ",")
+				for _, e := range events {
+					if e != EventBan && e != EventUnban && e != EventStorm {
+						err = errors.New("unknown event " + e)
+					}
+				}
+			case "token_env":
+				token = os.Getenv(v)
+			case "batch":
+				batch, err = time.ParseDuration(v)
+			case "interval":
+				interval, err = time.ParseDuration(v)
+			default:
+				err = errors.New(opt)
+			}
+			if err != nil {
+				return nil, errors.Join(ErrNotify, err)
+			}
+		}
+
+		sink, err := NewSink(f[0], f[1], token)
+		if err != nil {
+			return nil, err
+		}
+		n := NewNotifier(sink, batch, interval)
+		n.Events = events
+		n.MaxBatch = vars.NotifyBatchMax
+		n.Retries = vars.NotifyRetries
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, nil
+}
+
+// NewSink creates sink of kind posting to url
+func NewSink(kind, url, token string) (Sink, error) {
+	s := httpSink{url: url, token: token, client: &http.Client{Timeout: 10 * time.Second}}
+	switch kind {
+	case SinkWebhook:
+		return &WebhookSink{s}, nil
+	case SinkNtfy:
+		return &NtfySink{s}, nil
+	case SinkHomeAssistant:
+		return &HomeAssistantSink{s}, nil
+	case SinkAlertmanager:
+		s.url = strings.TrimSuffix(url, "/") + "/api/v2/alerts"
+		return &AlertmanagerSink{s}, nil
+	}
+	return nil, errors.Join(ErrNotify, errors.New("unknown sink "+kind))
+}
+
+func (n *Notifier) enqueue(e Event) {
+	if n.Events != nil && !slices.Contains(n.Events, e.Kind) {
+		return
+	}
+	select {
+	case n.queue <- e:
+	default:
+		n.dropped.Add(1)
+	}
+}
+
+// Run delivers queued events until ctx is done
+func (n *Notifier) Run(ctx context.Context) {
+	var last time.Time
+	for {
+		var batch []Event
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-n.queue:
+			batch = append(batch, e)
+		}
+
+		// collect until batch window ends, but not sooner than interval after last send
+		wait := max(n.Batch, time.Until(last.Add(n.Interval)))
+		t := time.NewTimer(wait)
+	collect:
+		for {
+			queue := n.queue
+			if n.MaxBatch > 0 && len(batch) >= n.MaxBatch {
+				queue = nil
+			}
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case e := <-queue:
+				batch = append(batch, e)
+			case <-t.C:
+				break collect
+			}
+		}
+
+		if d := n.dropped.Swap(0); d > 0 {
+			slog.Warn("notification queue full, events dropped", "sink", n.Sink.Name(), "val", d)
+		}
+		if err := n.send(ctx, batch); err != nil && ctx.Err() == nil {
+			slog.Error("sending notification", "sink", n.Sink.Name(), "events", len(batch), "val", err.Error())
+		}
+		last = time.Now()
+	}
+}
+
+// send delivers batch, retrying failures which are not rejections
+func (n *Notifier) send(ctx context.Context, batch []Event) error {
+	backoff := n.Backoff
+	for attempt := 0; ; attempt++ {
+		err := n.Sink.Send(ctx, batch)
+		if err == nil || errors.Is(err, errRejected) || attempt >= n.Retries {
+			return err
+		}
+		slog.Debug("retrying notification", "sink", n.Sink.Name(), "val", err.Error())
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		backoff *= 2
+	}
+}
+
+type httpSink struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// post sends body, client errors other than timeouts and throttling are rejections
+func (s *httpSink) post(ctx context.Context, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Join(errRejected, err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout &&
+		resp.StatusCode != http.StatusTooManyRequests:
+		return errors.Join(errRejected, errors.New(resp.Status))
+	}
+	return errors.New(resp.Status)
+}
+
+func (s *httpSink) postJSON(ctx context.Context, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return errors.Join(errRejected, err)
+	}
+	return s.post(ctx, body, nil)
+}
+
+// WebhookSink posts {"events": [...]} as JSON
+type WebhookSink struct {
+	httpSink
+}
+
+func (s *WebhookSink) Name() string { return SinkWebhook }
+
+func (s *WebhookSink) Send(ctx context.Context, events []Event) error {
+	return s.postJSON(ctx, map[string]any{"events": events})
+}
+
+// NtfySink publishes one message per batch to ntfy topic url
+type NtfySink struct {
+	httpSink
+}
+
+func (s *NtfySink) Name() string { return SinkNtfy }
+
+func (s *NtfySink) Send(ctx context.Context, events []Event) error {
+	var body strings.Builder
+	priority, tags := "default", []string{"shield"}
+	for _, e := range events {
+		body.WriteString(e.Summary())
+		body.WriteByte('\n')
+		if e.Kind == EventStorm {
+			priority, tags = "high", append(tags, "rotating_light")
+		}
+	}
+
+	title := "ratelimiter: " + events[0].Summary()
+	if len(events) > 1 {
+		title = "ratelimiter: " + strconv.Itoa(len(events)) + " events"
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Title", title)
+	header.Set("Priority", priority)
+	header.Set("Tags", strings.Join(slices.Compact(tags), ","))
+	return s.post(ctx, []byte(body.String()), header)
+}
+
+// HomeAssistantSink triggers webhook automation, payload carries counts per kind and summary so
+// automations can use trigger.json.bans or trigger.json.message directly
+type HomeAssistantSink struct {
+	httpSink
+}
+
+func (s *HomeAssistantSink) Name() string { return SinkHomeAssistant }
+
+func (s *HomeAssistantSink) Send(ctx context.Context, events []Event) error {
+	counts := map[string]int{}
+	lines := make([]string, 0, len(events))
+	for _, e := range events {
+		counts[e.Kind]++
+		lines = append(lines, e.Summary())
+	}
+	return s.postJSON(ctx, map[string]any{
+		"message": strings.Join(lines, "\n"),
+		"bans":    counts[EventBan],
+		"unbans":  counts[EventUnban],
+		"storms":  counts[EventStorm],
+		"events":  events,
+	})
+}
+
+// AlertmanagerSink posts alerts to Alertmanager v2 api, bans resolve at their end and unbans
+// resolve matching ban alert right away
+type AlertmanagerSink struct {
+	httpSink
+}
+
+type amAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt,omitzero"`
+}
+
+func (s *AlertmanagerSink) Name() string { return SinkAlertmanager }
+
+func (s *AlertmanagerSink) Send(ctx context.Context, events []Event) error {
+	alerts := make([]amAlert, 0, len(events))
+	for _, e := range events {
+		a := amAlert{
+			Labels:      map[string]string{"alertname": "RateLimiterBan", "ip": e.IP, "severity": "info"},
+			Annotations: map[string]string{"summary": e.Summary(), "reason": e.Reason},
+			StartsAt:    e.Time,
+			EndsAt:      e.Until,
+		}
+		switch e.Kind {
+		case EventUnban:
+			// start is kept by alertmanager for known alerts
+			a.EndsAt = e.Time
+		case EventStorm:
+			a.Labels = map[string]string{"alertname": "RateLimiterStorm", "severity": "warning"}
+			a.Annotations["busiest_client"] = e.IP
+		}
+		alerts = append(alerts, a)
+	}
+	return s.postJSON(ctx, alerts)
+}
@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const (
+	StateNone      = "none"
+	StateFile      = "file"
+	StateConfigMap = "configmap"
+	StateValkey    = "valkey"
+)
+
+// BlockEntry is exported state of a single tracked ip
+type BlockEntry struct {
+	IP       string    `json:"ip"`
+	Strikes  float64   `json:"strikes,omitempty"`
+	LastFail time.Time `json:"last_failure"`
+	Offences int       `json:"offences,omitempty"`
+	BannedAt time.Time `json:"banned_at"`
+	Until    time.Time `json:"until"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+type Snapshotter interface {
+	Snapshot() []BlockEntry
+	Restore(entries []BlockEntry) int
+}
+
+type StateStore interface {
+	Save(ctx context.Context, entries []BlockEntry) error
+	Load(ctx context.Context) ([]BlockEntry, error)
+}
+
+// NewStateStore creates store configured by STATE_BACKEND, false means persistence is disabled
+func NewStateStore(vars *EnvVars) (StateStore, bool, error) {
+	switch vars.StateBackend {
+	case StateFile:
+		return NewFileStore(vars.StateFile), true, nil
+	case StateConfigMap:
+		cm, err := initConfigMapClient(vars.Namespace)
+		if err != nil {
+			return nil, false, err
+		}
+		return NewConfigMapStore(cm, vars.StateConfigMap), true, nil
+	case StateValkey:
+		return NewValkeyStore(NewValkeyClient(vars), vars.StateKey), true, nil
+	case StateNone, "":
+		return nil, false, nil
+	default:
+		return nil, false, errors.New("unknown STATE_BACKEND: " + vars.StateBackend)
+	}
+}
+
+// byPriority orders entries worth keeping first: active bans, the longest first, then the other
+// records by last failure, the latest first
+func byPriority(now time.Time) func(a, b BlockEntry) int {
+	return func(a, b BlockEntry) int {
+		ab, bb := now.Before(a.Until), now.Before(b.Until)
+		switch {
+		case ab != bb && ab:
+			return -1
+		case ab != bb:
+			return 1
+		case ab:
+			return b.Until.Compare(a.Until)
+		}
+		return b.LastFail.Compare(a.LastFail)
+	}
+}
+
+// marshalCapped encodes entries within limit bytes, dropping the least important ones
+func marshalCapped(entries []BlockEntry, limit int) ([]byte, error) {
+	data, err := json.Marshal(entries)
+	if err != nil || len(data) <= limit {
+		return data, err
+	}
+
+	entries = slices.Clone(entries)
+	slices.SortFunc(entries, byPriority(time.Now()))
+	n := len(entries)
+	for len(data) > limit && n > 0 {
+		// shrink by average entry size, with margin so it rarely takes another round
+		n = min(n-1, n*limit/len(data)*95/100)
+		if data, err = json.Marshal(entries[:n]); err != nil {
+			return nil, err
+		}
+	}
+	slog.Warn("blocker state over size limit, dropped least important entries", "val", len(entries)-n,
+		"limit", limit)
+	return data, nil
+}
+
+// FileStore keeps state as json file, e.g. on a PVC
+type FileStore struct {
+	path string
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (f *FileStore) Save(_ context.Context, entries []BlockEntry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	// write and rename, so crash during write doesn't corrupt previous state
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".blocker-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+func (f *FileStore) Load(_ context.Context) ([]BlockEntry, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []BlockEntry
+	return entries, json.Unmarshal(data, &entries)
+}
+
+// Persister snapshots blocker state to a store periodically
+type Persister struct {
+	src      Snapshotter
+	store    StateStore
+	interval time.Duration
+}
+
+func NewPersister(src Snapshotter, store StateStore, interval time.Duration) *Persister {
+	return &Persister{src: src, store: store, interval: interval}
+}
+
+func (p *Persister) Restore(ctx context.Context) error {
+	entries, err := p.store.Load(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("blocker state restored", "val", p.src.Restore(entries), "stored", len(entries))
+	return nil
+}
+
+func (p *Persister) Save(ctx context.Context) error {
+	return p.store.Save(ctx, p.src.Snapshot())
+}
+
+// Run saves state every interval until ctx is done
+func (p *Persister) Run(ctx context.Context) {
+	if p.interval <= 0 {
+		return
+	}
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			sctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			if err := p.Save(sctx); err != nil {
+				slog.Error("saving blocker state", "val", err.Error())
+			}
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package lib_test
+
+import (
+	"context"
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPersistRoundTrip(t *testing.T) {
+	valkey := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	stores := map[string]lib.StateStore{
+		"file":      lib.NewFileStore(filepath.Join(t.TempDir(), "blocker.json")),
+		"configmap": lib.NewConfigMapStore(fake.NewClientset().CoreV1().ConfigMaps("ratelimiter"), "state"),
+		"valkey":    lib.NewValkeyStore(valkey, "ratelimiter:state"),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			jail := lib.JailPolicy{Durations: []time.Duration{time.Hour}, Memory: 24 * time.Hour}
+
+			empty := lib.NewIPBlocker(1, time.Hour, jail, 0)
+			if err := lib.NewPersister(empty, store, 0).Restore(ctx); err != nil {
+				t.Fatalf("restoring missing state: %v", err)
+			}
+
+			src := lib.NewIPBlocker(1, time.Hour, jail, 0)
+			src.Ban("203.0.113.1", 0, "test")
+			src.NotifyFailure("203.0.113.2", 1)
+			if err := lib.NewPersister(src, store, 0).Save(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			dst := lib.NewIPBlocker(1, time.Hour, jail, 0)
+			if err := lib.NewPersister(dst, store, 0).Restore(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if !dst.CheckBlocked("203.0.113.1") || dst.Len() != 1 {
+				t.Errorf("ban not restored, tracking %d", dst.Len())
+			}
+		})
+	}
+}
+
+func TestRestorePrunesExpired(t *testing.T) {
+	b := lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{Durations: []time.Duration{time.Hour}, Memory: time.Hour}, 0)
+	old := time.Now().Add(-48 * time.Hour)
+	n := b.Restore([]lib.BlockEntry{
+		{IP: "203.0.113.1", Offences: 1, LastFail: old, BannedAt: old, Until: old.Add(time.Hour)},
+		{IP: "203.0.113.2", Offences: 1, LastFail: time.Now(), BannedAt: time.Now(), Until: time.Now().Add(time.Hour)},
+	})
+	if n != 1 || b.CheckBlocked("203.0.113.1") || !b.CheckBlocked("203.0.113.2") {
+		t.Errorf("restored %d entries", n)
+	}
+}
+
+func TestRestoreCap(t *testing.T) {
+	now := time.Now()
+	b := lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{Memory: 24 * time.Hour}, 2)
+	n := b.Restore([]lib.BlockEntry{
+		{IP: "203.0.113.1", Offences: 1, LastFail: now, BannedAt: now.Add(-2 * time.Hour), Until: now.Add(-time.Hour)},
+		{IP: "203.0.113.2", Offences: 1, LastFail: now, BannedAt: now, Until: now.Add(time.Hour)},
+		{IP: "203.0.113.3", Offences: 2, LastFail: now, BannedAt: now, Until: now.Add(2 * time.Hour)},
+	})
+	if n != 2 || b.Len() != 2 || !b.CheckBlocked("203.0.113.2") || !b.CheckBlocked("203.0.113.3") {
+		t.Errorf("restored %d entries over cap, tracking %d", n, b.Len())
+	}
+}
+
+func TestConfigMapStoreCap(t *testing.T) {
+	ctx := context.Background()
+	cms := fake.NewClientset().CoreV1().ConfigMaps("ratelimiter")
+	store := lib.NewConfigMapStore(cms, "state")
+
+	// bans are last, so trimming has to reorder
+	now := time.Now()
+	entries := make([]lib.BlockEntry, 0, 20000)
+	for i := range 20000 {
+		e := lib.BlockEntry{IP: "2001:db8::" + strconv.FormatInt(int64(i), 16), Strikes: 0.5, Offences: 1,
+			LastFail: now, BannedAt: now.Add(-time.Hour), Until: now.Add(-time.Minute), Reason: "strike limit"}
+		if i >= 19900 {
+			e.Until = now.Add(time.Hour)
+		}
+		entries = append(entries, e)
+	}
+	if err := store.Save(ctx, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	cm, err := cms.Get(ctx, "state", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cm.Data["blocker.json"]); n > 1<<20-100<<10 {
+		t.Errorf("stored %d bytes", n)
+	}
+	loaded, err := store.Load(ctx)
+	if err != nil || len(loaded) < 100 || len(loaded) == len(entries) {
+		t.Fatalf("loaded %d entries: %v", len(loaded), err)
+	}
+	bans := 0
+	for _, e := range loaded {
+		if e.Until.After(now) {
+			bans++
+		}
+	}
+	if bans != 100 {
+		t.Errorf("kept %d of 100 bans", bans)
+	}
+}
@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/url"
+	"sync/atomic"
+)
+
+const (
+	LBRoundRobin = "roundrobin"
+	LBLeastConn  = "leastconn"
+	LBTwoChoices = "p2c"
+)
+
+var ErrLBPolicy = errors.New("unknown balancing policy")
+
+// ParseLBPolicy validates balancing policy name, empty name is round robin
+func ParseLBPolicy(s string) (string, error) {
+	switch s {
+	case "":
+		return LBRoundRobin, nil
+	case LBRoundRobin, LBLeastConn, LBTwoChoices:
+		return s, nil
+	}
+	return "", errors.Join(ErrLBPolicy, errors.New(s))
+}
+
+type Upstream struct {
+	URL url.URL
+
+	down   atomic.Bool
+	fails  atomic.Int32
+	active atomic.Int64
+}
+
+func (u *Upstream) Healthy() bool {
+	return !u.down.Load()
+}
+
+func (u *Upstream) Active() int64 {
+	return u.active.Load()
+}
+
+// Pool is a set of upstream targets for a single route, balanced by policy
+type Pool struct {
+	Targets []*Upstream
+	policy  string
+	next    atomic.Uint64
+}
+
+func NewPool(policy string, targets []url.URL) *Pool {
+	p := &Pool{policy: policy, Targets: make([]*Upstream, 0, len(targets))}
+	for _, t := range targets {
+		p.Targets = append(p.Targets, &Upstream{URL: t})
+	}
+	return p
+}
+
+func (p *Pool) Policy() string {
+	return p.policy
+}
+
+// Pick selects a healthy upstream, if all upstreams are down whole pool is used
+func (p *Pool) Pick() *Upstream {
+	cand := make([]*Upstream, 0, len(p.Targets))
+	for _, u := range p.Targets {
+		if u.Healthy() {
+			cand = append(cand, u)
+		}
+	}
+	if len(cand) == 0 {
+		cand = p.Targets
+	}
+	if len(cand) == 1 {
+		return cand[0]
+	}
+
+	switch p.policy {
+	case LBLeastConn:
+		best := cand[0]
+		for _, u := range cand[1:] {
+			if u.Active() < best.Active() {
+				best = u
+			}
+		}
+		return best
+	case LBTwoChoices:
+		// balancing doesn't need crypto random
+		a, b := cand[rand.IntN(len(cand))], cand[rand.IntN(len(cand))]
+		if b.Active() < a.Active() {
+			return b
+		}
+		return a
+	default:
+		return cand[(p.next.Add(1)-1)%uint64(len(cand))]
+	}
+}
@@ -0,0 +1,103 @@
+package lib_test
+
+import (
+	"context"
+	"errors"
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolRoundRobin(t *testing.T) {
+	a, _ := url.Parse("http://a")
+	b, _ := url.Parse("http://b")
+	p := lib.NewPool(lib.LBRoundRobin, []url.URL{*a, *b})
+
+	seen := map[string]int{}
+	for range 4 {
+		seen[p.Pick().URL.Host]++
+	}
+	if seen["a"] != 2 || seen["b"] != 2 {
+		t.Errorf("round robin is uneven: %v", seen)
+	}
+}
+
+func TestParseLBPolicy(t *testing.T) {
+	tests := map[string]string{
+		"":               lib.LBRoundRobin,
+		lib.LBRoundRobin: lib.LBRoundRobin,
+		lib.LBLeastConn:  lib.LBLeastConn,
+		lib.LBTwoChoices: lib.LBTwoChoices,
+	}
+	for in, want := range tests {
+		if got, err := lib.ParseLBPolicy(in); err != nil || got != want {
+			t.Errorf("ParseLBPolicy(%q) got %q, %v want %q", in, got, err, want)
+		}
+	}
+	if _, err := lib.ParseLBPolicy("leastconns"); !errors.Is(err, lib.ErrLBPolicy) {
+		t.Errorf("unknown policy accepted: %v", err)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer good.Close()
+
+	badURL, _ := url.Parse(bad.URL)
+	goodURL, _ := url.Parse(good.URL)
+	p := lib.NewPool(lib.LBLeastConn, []url.URL{*badURL, *goodURL})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lib.StartHealthChecks(ctx, []*lib.Route{{Name: "x", Pool: p}}, "/health", 20*time.Millisecond, time.Second, 1)
+
+	eventually(t, func() bool { return !p.Targets[0].Healthy() }, "failing upstream still in pool")
+	for range 3 {
+		if p.Pick() != p.Targets[1] {
+			t.Fatal("picked unhealthy upstream")
+		}
+	}
+}
+
+func TestPoolHealthRecovery(t *testing.T) {
+	var fail atomic.Bool
+	var probes atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		probes.Add(1)
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	p := lib.NewPool(lib.LBRoundRobin, []url.URL{*u})
+	fail.Store(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lib.StartHealthChecks(ctx, []*lib.Route{{Name: "x", Pool: p}}, "/health", 10*time.Millisecond, time.Second, 3)
+
+	eventually(t, func() bool { return !p.Targets[0].Healthy() }, "failing upstream still in pool")
+	if n := probes.Load(); n < 3 {
+		t.Errorf("upstream taken out after %d failed probes", n)
+	}
+	fail.Store(false)
+	eventually(t, p.Targets[0].Healthy, "recovered upstream not back in pool")
+}
+
+func eventually(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+	}
+}
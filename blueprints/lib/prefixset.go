@@ -0,0 +1,166 @@
+package lib
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+// PrefixSet is a concurrent set of networks, lookup checks only prefix lengths present in the set
+type PrefixSet struct {
+	prefixes map[netip.Prefix]struct{}
+	bits     []int
+	mu       sync.RWMutex
+}
+
+func NewPrefixSet(prefixes ...netip.Prefix) *PrefixSet {
+	s := &PrefixSet{}
+	s.Replace(prefixes)
+	return s
+}
+
+// ParsePrefix parses CIDR or single address
+func ParsePrefix(v string) (netip.Prefix, error) {
+	if p, err := netip.ParsePrefix(v); err == nil {
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(v)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func (s *PrefixSet) Contains(addr netip.Addr) bool {
+	_, ok := s.Lookup(addr)
+	return ok
+}
+
+// Lookup returns the longest prefix of the set containing addr, nil set is empty
+func (s *PrefixSet) Lookup(addr netip.Addr) (netip.Prefix, bool) {
+	if s == nil {
+		return netip.Prefix{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	addr = addr.Unmap()
+	for i := len(s.bits) - 1; i >= 0; i-- {
+		if s.bits[i] > addr.BitLen() {
+			continue
+		}
+		p, err := addr.Prefix(s.bits[i])
+		if err != nil {
+			continue
+		}
+		if _, ok := s.prefixes[p]; ok {
+			return p, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// Overlaps returns a prefix of the set overlapping p, either containing it or inside it
+func (s *PrefixSet) Overlaps(p netip.Prefix) (netip.Prefix, bool) {
+	if q, ok := s.Lookup(p.Addr()); ok || s == nil {
+		return q, ok
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for q := range s.prefixes {
+		if p.Overlaps(q) {
+			return q, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+func (s *PrefixSet) Add(p netip.Prefix) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(p.Masked())
+}
+
+func (s *PrefixSet) Remove(p netip.Prefix) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p = p.Masked()
+	if _, ok := s.prefixes[p]; !ok {
+		return false
+	}
+	delete(s.prefixes, p)
+	s.reindex()
+	return true
+}
+
+// Update adds and removes prefixes in one step, removals are applied first
+func (s *PrefixSet) Update(add, remove []netip.Prefix) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range remove {
+		delete(s.prefixes, p.Masked())
+	}
+	if len(remove) > 0 {
+		s.reindex()
+	}
+	for _, p := range add {
+		s.add(p.Masked())
+	}
+}
+
+// Replace swaps content of the set
+func (s *PrefixSet) Replace(prefixes []netip.Prefix) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prefixes = make(map[netip.Prefix]struct{}, len(prefixes))
+	s.bits = s.bits[:0]
+	for _, p := range prefixes {
+		s.add(p.Masked())
+	}
+}
+
+func (s *PrefixSet) List() []netip.Prefix {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]netip.Prefix, 0, len(s.prefixes))
+	for p := range s.prefixes {
+		list = append(list, p)
+	}
+	slices.SortFunc(list, func(a, b netip.Prefix) int {
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c
+		}
+		return a.Bits() - b.Bits()
+	})
+	return list
+}
+
+func (s *PrefixSet) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.prefixes)
+}
+
+// add inserts prefix, caller must hold mu
+func (s *PrefixSet) add(p netip.Prefix) {
+	s.prefixes[p] = struct{}{}
+	if i, found := slices.BinarySearch(s.bits, p.Bits()); !found {
+		s.bits = slices.Insert(s.bits, i, p.Bits())
+	}
+}
+
+// reindex rebuilds list of used prefix lengths, caller must hold mu
+func (s *PrefixSet) reindex() {
+	s.bits = s.bits[:0]
+	for p := range s.prefixes {
+		if i, found := slices.BinarySearch(s.bits, p.Bits()); !found {
+			s.bits = slices.Insert(s.bits, i, p.Bits())
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProxyProtoOff    = "off"
+	ProxyProtoOn     = "on"
+	ProxyProtoStrict = "strict"
+
+	proxyV1Prefix      = "PROXY "
+	proxyV1MaxLen      = 107
+	proxyV2HdrLen      = 16
+	proxyHeaderTimeout = 5 * time.Second
+)
+
+var (
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	ErrProxyHeader    = errors.New("invalid proxy protocol header")
+	ErrProxyRequired  = errors.New("proxy protocol header required")
+	ErrProxyUntrusted = errors.New("proxy protocol header from untrusted peer")
+)
+
+// ProxyProtoListener decodes HAProxy PROXY protocol v1/v2 headers on accepted connections.
+// Headers are accepted only from trusted peers, anyone else sending one is rejected, so clients
+// can't spoof their address. In strict mode only trusted peers may connect without a header.
+type ProxyProtoListener struct {
+	net.Listener
+	trusted TrustedProxies
+	strict  bool
+}
+
+func NewProxyProtoListener(l net.Listener, t TrustedProxies, strict bool) *ProxyProtoListener {
+	return &ProxyProtoListener{Listener: l, trusted: t, strict: strict}
+}
+
+// Listen creates tcp listener for addr, wrapped by PROXY protocol decoder if enabled
+func Listen(addr string, vars *EnvVars) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch vars.ProxyProtocol {
+	case ProxyProtoOn, ProxyProtoStrict:
+		return NewProxyProtoListener(l, vars.TrustedProxies, vars.ProxyProtocol == ProxyProtoStrict), nil
+	case ProxyProtoOff, "":
+		return l, nil
+	default:
+		_ = l.Close()
+		return nil, errors.New("unknown PROXY_PROTOCOL mode: " + vars.ProxyProtocol)
+	}
+}
+
+func (l *ProxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c), l: l}, nil
+}
+
+// proxyConn reads the header lazily, so slow clients don't block Accept loop
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+	l *ProxyProtoListener
+
+	once sync.Once
+	src  net.Addr
+	err  error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		if err := c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+			c.err = err
+			return
+		}
+		c.src, c.err = c.readHeader()
+		if c.err != nil {
+			slog.Warn("proxy protocol", "val", c.err.Error(), lIP, c.Conn.RemoteAddr().String())
+			return
+		}
+		c.err = c.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyConn) readHeader() (net.Addr, error) {
+	b, err := c.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	v1 := b[0] == proxyV1Prefix[0] && c.hasPrefix([]byte(proxyV1Prefix))
+	v2 := !v1 && b[0] == proxyV2Sig[0] && c.hasPrefix(proxyV2Sig)
+	trusted := c.peerTrusted()
+
+	switch {
+	case (v1 || v2) && !trusted:
+		return nil, ErrProxyUntrusted
+	case v1:
+		return c.readV1()
+	case v2:
+		return c.readV2()
+	case c.l.strict && !trusted:
+		return nil, ErrProxyRequired
+	}
+	return nil, nil
+}
+
+func (c *proxyConn) hasPrefix(p []byte) bool {
+	b, err := c.r.Peek(len(p))
+	return err == nil && bytes.Equal(b, p)
+}
+
+func (c *proxyConn) peerTrusted() bool {
+	peer, err := netip.ParseAddrPort(c.Conn.RemoteAddr().String())
+	return err == nil && c.l.trusted.Contains(peer.Addr())
+}
+
+// readV1 parses "PROXY TCP4 src dst sport dport\r\n"
+func (c *proxyConn) readV1() (net.Addr, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil || len(line) > proxyV1MaxLen {
+		return nil, ErrProxyHeader
+	}
+
+	f := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, ErrProxyHeader
+	}
+
+	addr, err := netip.ParseAddr(f[2])
+	if err != nil {
+		return nil, ErrProxyHeader
+	}
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if err != nil {
+		return nil, ErrProxyHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr.Unmap(), uint16(port))), nil
+}
+
+// readV2 parses binary header, LOCAL command and unsupported families keep the peer address
+func (c *proxyConn) readV2() (net.Addr, error) {
+	hdr := make([]byte, proxyV2HdrLen)
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		return nil, ErrProxyHeader
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, ErrProxyHeader
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return nil, ErrProxyHeader
+	}
+
+	const (
+		cmdLocal = 0x0
+		cmdProxy = 0x1
+		famInet  = 0x1
+		famInet6 = 0x2
+	)
+	switch hdr[12] & 0xF {
+	case cmdLocal:
+		return nil, nil
+	case cmdProxy:
+	default:
+		return nil, ErrProxyHeader
+	}
+
+	var addr netip.Addr
+	var port uint16
+	switch hdr[13] >> 4 {
+	case famInet:
+		if len(body) < 12 {
+			return nil, ErrProxyHeader
+		}
+		addr = netip.AddrFrom4([4]byte(body[0:4]))
+		port = binary.BigEndian.Uint16(body[8:10])
+	case famInet6:
+		if len(body) < 36 {
+			return nil, ErrProxyHeader
+		}
+		addr = netip.AddrFrom16([16]byte(body[0:16])).Unmap()
+		port = binary.BigEndian.Uint16(body[32:34])
+	default:
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+}
@@ -0,0 +1,102 @@
+package lib_test
+
+import (
+	"encoding/binary"
+	"io"
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func proxyV2(src netip.AddrPort) []byte {
+	b := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c")
+	a := src.Addr().As4()
+	b = append(b, a[:]...)
+	b = append(b, 10, 0, 0, 1)
+	b = binary.BigEndian.AppendUint16(b, src.Port())
+	return binary.BigEndian.AppendUint16(b, 80)
+}
+
+func acceptWith(t *testing.T, strict bool, trusted lib.TrustedProxies, payload []byte) (string, string, error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pl := lib.NewProxyProtoListener(l, trusted, strict)
+
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = c.Write(payload)
+	}()
+
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	remote := c.RemoteAddr().String()
+	data, err := io.ReadAll(c)
+	return remote, string(data), err
+}
+
+func TestProxyProtocol(t *testing.T) {
+	loopback := lib.TrustedProxies{netip.MustParsePrefix("127.0.0.0/8")}
+	body := "GET / HTTP/1.1\r\n\r\n"
+
+	tests := []struct {
+		name    string
+		strict  bool
+		trusted lib.TrustedProxies
+		payload []byte
+		remote  string
+		fail    bool
+	}{
+		{"v1 tcp4", false, loopback, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\n" + body), "203.0.113.7:5555", false},
+		{"v1 tcp6", false, loopback, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 5555 80\r\n" + body), "[2001:db8::1]:5555", false},
+		{"v1 unknown", false, loopback, []byte("PROXY UNKNOWN\r\n" + body), "", false},
+		{"v1 garbage", false, loopback, []byte("PROXY TCP4 nope\r\n" + body), "", true},
+		{"v2 tcp4", false, loopback, append(proxyV2(netip.MustParseAddrPort("198.51.100.3:4242")), body...), "198.51.100.3:4242", false},
+		{"v1 untrusted", false, nil, []byte("PROXY TCP4 10.0.0.9 10.0.0.1 5555 80\r\n" + body), "", true},
+		{"v2 untrusted", true, nil, append(proxyV2(netip.MustParseAddrPort("10.0.0.9:4242")), body...), "", true},
+		{"no header", false, nil, []byte(body), "", false},
+		{"post without header", false, nil, []byte("POST / HTTP/1.1\r\n\r\n"), "", false},
+		{"strict untrusted", true, nil, []byte(body), "", true},
+		{"strict trusted", true, loopback, []byte(body), "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote, data, err := acceptWith(t, tt.strict, tt.trusted, tt.payload)
+			if tt.fail {
+				if err == nil {
+					t.Errorf("expected error, got data %q", data)
+				}
+				if netip.MustParseAddrPort(remote).Addr().String() != "127.0.0.1" {
+					t.Errorf("remote addr %s taken from rejected header", remote)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.remote != "" && remote != tt.remote {
+				t.Errorf("remote addr %s, expected %s", remote, tt.remote)
+			}
+			if tt.remote == "" && netip.MustParseAddrPort(remote).Addr().String() != "127.0.0.1" {
+				t.Errorf("remote addr %s, expected peer address", remote)
+			}
+			if !strings.HasSuffix(data, "HTTP/1.1\r\n\r\n") {
+				t.Errorf("payload not passed through: %q", data)
+			}
+		})
+	}
+}
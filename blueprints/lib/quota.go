@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quota is bucket state of a client: Limit requests per Window, Remaining of them available now,
+// Reset until all of them are available again and RetryAfter until the next one is
+type Quota struct {
+	Limit      int
+	Window     time.Duration
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// SetHeaders sets RateLimit-Policy and RateLimit headers of draft-ietf-httpapi-ratelimit-headers,
+// e.g. `"default";q=10;w=5` and `"default";r=3;t=2`
+func (q Quota) SetHeaders(h http.Header, policy string) {
+	name := sfString(policy)
+	h.Set("RateLimit-Policy", name+";q="+strconv.Itoa(q.Limit)+";w="+seconds(q.Window))
+	h.Set("RateLimit", name+";r="+strconv.Itoa(max(q.Remaining, 0))+";t="+seconds(q.Reset))
+}
+
+// seconds formats d as whole seconds rounded up
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(max(d, 0).Seconds())), 10)
+}
+
+// sfString quotes s as structured field string, characters it can't carry are replaced
+func sfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < ' ' || r > '~':
+			b.WriteByte('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
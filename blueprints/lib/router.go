@@ -1,25 +1,36 @@
 package lib
 
 import (
+	"bufio"
 	"log/slog"
+	"net"
 	"net/http"
-	"net/url"
+	"net/netip"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	lIP    = "ip"
-	lRate  = "ratelimit"
-	lRoute = "notrouted"
+	lIP      = "ip"
+	lRate    = "ratelimit"
+	lRoute   = "notrouted"
+	lInspect = "inspection"
+	lDeny    = "denylist"
 )
 
 type proxyResponseWriter struct {
-	w http.ResponseWriter
-	f ClientFilter
-	i string
-	h string
-	m *Metrics
+	w  http.ResponseWriter
+	f  ClientFilter
+	i  string
+	h  string
+	m  *Metrics
+	rt *Route
+	p  string
+	a  bool
+	// q is client's rate limit state sent with the response, nil for allowlisted clients
+	q      *Quota
+	policy string
 }
 
 func (p *proxyResponseWriter) Header() http.Header {
@@ -29,32 +40,75 @@ func (p *proxyResponseWriter) Header() http.Header {
 func (p *proxyResponseWriter) Write(data []byte) (int, error) {
 	return p.w.Write(data)
 }
+
 func (p *proxyResponseWriter) WriteHeader(statusCode int) {
-	if statusCode > 399 {
-		slog.Warn("User got blocked", "code", statusCode, lIP, p.i)
+	// informational responses are followed by the final one
+	if statusCode < http.StatusOK && statusCode != http.StatusSwitchingProtocols {
+		p.w.WriteHeader(statusCode)
+		return
+	}
+
+	if weight := p.rt.Strikes.Weight(p.p, statusCode); weight > 0 && !p.a {
+		slog.Warn("User got blocked", "code", statusCode, lIP, p.i, "weight", weight)
 		p.m.Blocked(lIP, p.i, p.h, strconv.Itoa(statusCode))
-		p.f.NotifyFailure(p.i)
+		p.f.NotifyFailure(p.i, weight)
 	} else {
 		p.m.RequestsTotal.WithLabelValues(p.h, strconv.Itoa(statusCode)).Inc()
 	}
+	// replaces upstream's own headers, its limits are not the ones client hits first
+	if p.q != nil {
+		p.q.SetHeaders(p.w.Header(), p.policy)
+	}
 	p.w.WriteHeader(statusCode)
 }
 
+func (p *proxyResponseWriter) Unwrap() http.ResponseWriter {
+	return p.w
+}
+
+func (p *proxyResponseWriter) Flush() {
+	if err := http.NewResponseController(p.w).Flush(); err != nil {
+		slog.Warn("flush failed", "val", err.Error())
+	}
+}
+
+// Hijack takes over connection for protocol upgrades, proxy writes 101 response to the hijacked
+// connection directly, so it is accounted here
+func (p *proxyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(p.w).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	p.m.RequestsTotal.WithLabelValues(p.h, strconv.Itoa(http.StatusSwitchingProtocols)).Inc()
+	return conn, brw, nil
+}
+
 type Router struct {
 	handler http.Handler
 	bucket  Bucket
 	clientF ClientFilter
 	metrics *Metrics
-	routing map[string]url.URL
+	routing *RouteTable
+	trusted TrustedProxies
+	resp    BlockResponses
+	inspect *Inspector
+	lists   *AccessLists
 }
 
-func NewRouter(h http.Handler, b Bucket, c ClientFilter, m *Metrics, r map[string]url.URL) *Router {
+func NewRouter(
+	h http.Handler, b Bucket, c ClientFilter, m *Metrics, r *RouteTable, t TrustedProxies, br BlockResponses,
+	in *Inspector, al *AccessLists,
+) *Router {
 	return &Router{
 		handler: h,
 		bucket:  b,
 		clientF: c,
 		metrics: m,
 		routing: r,
+		trusted: t,
+		resp:    br,
+		inspect: in,
+		lists:   al,
 	}
 }
 
@@ -62,50 +116,134 @@ func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ip := rt.getClientIP(r)
 	host := CutPort(r.Host)
 
-	if rt.clientF.CheckBlocked(ip) {
-		rt.clientF.NotifyFailure(ip)
-		slog.Error("blocked ip", "val", ip)
-		w.WriteHeader(414)
-		rt.metrics.Blocked(lIP, ip, host, "414")
+	// allowlisted clients skip bans, inspection and rate limits
+	allowed := rt.allowed(ip)
+	route := rt.routing.Match(host, r.Method, r.URL.Path)
+	if !allowed && (rt.denied(w, r, ip, host) || rt.rejected(w, r, ip, host)) {
 		return
 	}
-	if !rt.bucket.GetToken() {
-		slog.Error("rate limited")
-		w.WriteHeader(414)
-		rt.metrics.Blocked(lRate, ip, host, "415")
-		return
+	// quota of the token taken is sent with the response
+	var quota *Quota
+	bucket, policy := rt.bucketFor(route)
+	if !allowed {
+		ok, q := bucket.Take(ip)
+		if !ok {
+			rt.limited(w, r, q, policy, ip, host)
+			return
+		}
+		quota = &q
 	}
-	_, ok := rt.routing[host]
-	if !ok {
+	if route == nil {
 		slog.Error("routing not found", "val", host)
-		w.WriteHeader(http.StatusNotFound)
-		rt.metrics.Blocked(lRoute, ip, host, strconv.Itoa(http.StatusNotFound))
+		status := rt.resp.Write(w, r, ReasonNotRouted, 0)
+		rt.metrics.Blocked(lRoute, ip, host, strconv.Itoa(status))
 		return
 	}
 
-	rt.handler.ServeHTTP(&proxyResponseWriter{w: w, f: rt.clientF, i: ip, h: host, m: rt.metrics}, r)
+	r, slot := withRouteSlot(r, route)
+	defer slot.release()
+	pw := &proxyResponseWriter{w: w, f: rt.clientF, i: ip, h: host, m: rt.metrics, rt: route, p: r.URL.Path, a: allowed}
+	pw.q, pw.policy = quota, policy
+	rt.handler.ServeHTTP(pw, r)
 }
 
-func (rt *Router) getClientIP(r *http.Request) string {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		ips := strings.Split(xff, ",")
-		return strings.TrimSpace(ips[0])
+// bucketFor returns bucket limiting route and name of its policy, routes with own limit use their
+// bucket instead of the default one
+func (rt *Router) bucketFor(route *Route) (Bucket, string) {
+	if route != nil && route.Bucket != nil {
+		return route.Bucket, route.Name
 	}
+	return rt.bucket, "default"
+}
 
-	if xRealIP := r.Header.Get("X-Real-Ip"); xRealIP != "" {
-		return strings.TrimSpace(xRealIP)
+func (rt *Router) allowed(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	list, _, ok := rt.lists.Allowed(addr)
+	if ok {
+		rt.metrics.ListHits.WithLabelValues(list, ListAllow).Inc()
 	}
+	return ok
+}
+
+// denied answers requests of denylisted clients, returns true if request was answered
+func (rt *Router) denied(w http.ResponseWriter, r *http.Request, ip, host string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	list, p, ok := rt.lists.Denied(addr)
+	if !ok {
+		return false
+	}
+	slog.Error("denylisted ip", "val", ip, "list", list, "prefix", p.String())
+	rt.metrics.ListHits.WithLabelValues(list, ListDeny).Inc()
+	status := rt.resp.Write(w, r, ReasonBanned, 0)
+	rt.metrics.Blocked(lDeny, ip, host, strconv.Itoa(status))
+	return true
+}
 
-	idx := strings.LastIndex(r.RemoteAddr, ":")
-	if idx >= 0 {
-		return r.RemoteAddr[:idx]
+// rejected applies bans and inspection rules, returns true if request was answered
+func (rt *Router) rejected(w http.ResponseWriter, r *http.Request, ip, host string) bool {
+	if rt.clientF.CheckBlocked(ip) {
+		slog.Error("blocked ip", "val", ip)
+		status := rt.resp.Write(w, r, ReasonBanned, rt.clientF.BannedFor(ip))
+		rt.metrics.Blocked(lIP, ip, host, strconv.Itoa(status))
+		return true
 	}
-	return r.RemoteAddr
+	rule := rt.inspect.Match(r)
+	return rule != nil && rt.inspected(w, r, rule, ip, host)
+}
+
+// limited answers request rejected by rate limit
+func (rt *Router) limited(w http.ResponseWriter, r *http.Request, q Quota, policy, ip, host string) {
+	slog.Error("rate limited", "val", ip)
+	q.SetHeaders(w.Header(), policy)
+	// Retry-After is always sent, even when bucket refills within a second
+	status := rt.resp.Write(w, r, ReasonRateLimited, max(q.RetryAfter, time.Millisecond))
+	rt.metrics.Blocked(lRate, ip, host, strconv.Itoa(status))
+}
+
+// inspected applies action of matched inspection rule, returns true if request was answered
+func (rt *Router) inspected(w http.ResponseWriter, r *http.Request, rule *InspectRule, ip, host string) bool {
+	slog.Warn("inspection rule matched", "rule", rule.Name, "action", rule.Action, lIP, ip, "path", r.URL.Path)
+	rt.metrics.InspectedTotal.WithLabelValues(rule.Name, rule.Action).Inc()
+
+	switch rule.Action {
+	case ActionBan:
+		rt.clientF.Ban(ip, 0, "inspection rule "+rule.Name)
+		status := rt.resp.Write(w, r, ReasonBanned, rt.clientF.BannedFor(ip))
+		rt.metrics.Blocked(lIP, ip, host, strconv.Itoa(status))
+		return true
+	case ActionStrike:
+		rt.clientF.NotifyFailure(ip, rule.Weight)
+	case ActionTarpit:
+		if !rt.inspect.Tarpit(r.Context(), rule.delay) {
+			slog.Debug("tarpit full, answering at once", lIP, ip)
+		}
+		status := rt.resp.Write(w, r, ReasonNotRouted, 0)
+		rt.metrics.Blocked(lInspect, ip, host, strconv.Itoa(status))
+		return true
+	}
+	return false
+}
+
+func (rt *Router) getClientIP(r *http.Request) string {
+	peer, err := ParseHostAddr(r.RemoteAddr)
+	if err != nil {
+		return CutPort(r.RemoteAddr)
+	}
+
+	xff := r.Header.Values("X-Forwarded-For")
+	return rt.trusted.ClientAddr(peer, xff, r.Header.Get("X-Real-Ip")).String()
 }
 
-func CutPort(url string) string {
-	if idx := strings.LastIndex(url, ":"); idx != -1 {
-		return url[:idx]
+// CutPort strips port from host or address, IPv6 literals lose their brackets
+func CutPort(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
 	}
-	return url
+	return strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
 }
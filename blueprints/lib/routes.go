@@ -0,0 +1,277 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrRule = errors.New("invalid route rule")
+
+// Route sends requests matching path prefix or regex, and optionally method, to its pool
+type Route struct {
+	Name    string
+	Prefix  string
+	Regex   *regexp.Regexp
+	Methods []string
+	// Strip removes matched prefix, Rewrite replaces it, for regex rules Rewrite is an expand template
+	Strip   bool
+	Rewrite string
+	Pool    *Pool
+	Strikes *StrikePolicy
+	// Limit replaces default rate limit for the route, Bucket holds its per client buckets
+	Limit  *LimitPolicy
+	Bucket Bucket
+}
+
+func (r *Route) Match(method, path string) bool {
+	if len(r.Methods) > 0 && !slices.Contains(r.Methods, method) {
+		return false
+	}
+	if r.Regex != nil {
+		return r.Regex.MatchString(path)
+	}
+	return strings.HasPrefix(path, r.Prefix)
+}
+
+// RewritePath returns upstream path for request path
+func (r *Route) RewritePath(path string) string {
+	switch {
+	case r.Regex != nil && r.Rewrite != "":
+		path = r.Regex.ReplaceAllString(path, r.Rewrite)
+	case r.Regex == nil && (r.Strip || r.Rewrite != ""):
+		path = r.Rewrite + strings.TrimPrefix(path, r.Prefix)
+	default:
+		return path
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+func (r *Route) pattern() string {
+	if r.Regex != nil {
+		return "~" + r.Regex.String()
+	}
+	return r.Prefix
+}
+
+type hostRoutes struct {
+	re     *regexp.Regexp
+	routes []*Route
+}
+
+// RouteTable resolves host, method and path to a route. Host is matched exactly first, then by
+// longest wildcard "*.example.top" (matching one or more labels), then by regex "~pattern" in order
+// they were added. Rules of the matched host are checked in order.
+type RouteTable struct {
+	hosts     map[string][]*Route
+	wildcards map[string][]*Route
+	regexes   []*hostRoutes
+}
+
+func NewRouteTable() *RouteTable {
+	return &RouteTable{
+		hosts:     make(map[string][]*Route, 3),
+		wildcards: make(map[string][]*Route),
+	}
+}
+
+func (t *RouteTable) Add(host string, routes ...*Route) error {
+	for _, r := range routes {
+		if r.Name == "" {
+			r.Name = host + r.pattern()
+		}
+	}
+
+	if pattern, ok := strings.CutPrefix(host, "~"); ok {
+		for _, h := range t.regexes {
+			if h.re.String() == pattern {
+				h.routes = append(h.routes, routes...)
+				return nil
+			}
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.Join(ErrRule, err)
+		}
+		t.regexes = append(t.regexes, &hostRoutes{re: re, routes: routes})
+		return nil
+	}
+
+	host = strings.ToLower(host)
+	if suffix, ok := strings.CutPrefix(host, "*"); ok {
+		t.wildcards[suffix] = append(t.wildcards[suffix], routes...)
+		return nil
+	}
+	t.hosts[host] = append(t.hosts[host], routes...)
+	return nil
+}
+
+func (t *RouteTable) Match(host, method, path string) *Route {
+	for _, r := range t.resolveHost(strings.ToLower(host)) {
+		if r.Match(method, path) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (t *RouteTable) resolveHost(host string) []*Route {
+	if rs, ok := t.hosts[host]; ok {
+		return rs
+	}
+
+	// walking from the left finds the longest suffix first
+	for i := range len(host) {
+		if host[i] != '.' {
+			continue
+		}
+		if rs, ok := t.wildcards[host[i:]]; ok && i > 0 {
+			return rs
+		}
+	}
+
+	for _, h := range t.regexes {
+		if h.re.MatchString(host) {
+			return h.routes
+		}
+	}
+	return nil
+}
+
+// InitLimits creates per client buckets of routes with own limit, wrap applies the same client
+// identity as default bucket. Route buckets are local to the replica and skip the global cap.
+// Idle buckets are dropped after idle, but not before their window passes.
+func (t *RouteTable) InitLimits(idle time.Duration, wrap func(Bucket) Bucket) {
+	for _, r := range t.Routes() {
+		if r.Limit == nil || r.Bucket != nil {
+			continue
+		}
+		r.Bucket = NewClientBuckets(r.Limit.New, max(idle, r.Limit.Window), nil, nil)
+		if wrap != nil {
+			r.Bucket = wrap(r.Bucket)
+		}
+	}
+}
+
+func (t *RouteTable) Routes() []*Route {
+	routes := make([]*Route, 0, len(t.hosts))
+	for _, rs := range t.hosts {
+		routes = append(routes, rs...)
+	}
+	for _, rs := range t.wildcards {
+		routes = append(routes, rs...)
+	}
+	for _, h := range t.regexes {
+		routes = append(routes, h.routes...)
+	}
+	return routes
+}
+
+// ParseTargets parses comma separated list of upstream urls, scheme defaults to http
+func ParseTargets(v string) ([]url.URL, error) {
+	targets := make([]url.URL, 0, 1)
+	for t := range strings.SplitSeq(v, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if !strings.HasPrefix(t, "http") {
+			t = "http://" + t
+		}
+		u, err := url.Parse(t)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, *u)
+	}
+	if len(targets) == 0 {
+		return nil, ErrRule
+	}
+	return targets, nil
+}
+
+// ParseRules parses ';' separated rules in form
+// "<path> [METHOD,..] [strip] [rewrite=<path>] [limit=<algorithm>:<n>/<window>] <targets>",
+// path starting with '~' is a regex
+func ParseRules(spec, policy string) ([]*Route, error) {
+	var routes []*Route
+	for rule := range strings.SplitSeq(spec, ";") {
+		f := strings.Fields(rule)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) < 2 {
+			return nil, errors.Join(ErrRule, errors.New(rule))
+		}
+
+		targets, err := ParseTargets(f[len(f)-1])
+		if err != nil {
+			return nil, errors.Join(ErrRule, err)
+		}
+		r := &Route{Pool: NewPool(policy, targets)}
+
+		if re, ok := strings.CutPrefix(f[0], "~"); ok {
+			if r.Regex, err = regexp.Compile(re); err != nil {
+				return nil, errors.Join(ErrRule, err)
+			}
+		} else {
+			r.Prefix = f[0]
+		}
+
+		for _, opt := range f[1 : len(f)-1] {
+			switch {
+			case opt == "strip":
+				r.Strip = true
+			case strings.HasPrefix(opt, "rewrite="):
+				r.Rewrite = strings.TrimPrefix(opt, "rewrite=")
+			case strings.HasPrefix(opt, "limit="):
+				if r.Limit, err = ParseLimitPolicy(strings.TrimPrefix(opt, "limit=")); err != nil {
+					return nil, errors.Join(ErrRule, err)
+				}
+			case strings.ToUpper(opt) == opt:
+				r.Methods = strings.Split(opt, ",")
+			default:
+				return nil, errors.Join(ErrRule, errors.New(opt))
+			}
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+type routeCtxKey struct{}
+
+// routeSlot carries route resolved by Router and upstream picked by proxy, so the upstream can be
+// released after request is done
+type routeSlot struct {
+	route *Route
+	u     *Upstream
+}
+
+func withRouteSlot(r *http.Request, route *Route) (*http.Request, *routeSlot) {
+	slot := &routeSlot{route: route}
+	return r.WithContext(context.WithValue(r.Context(), routeCtxKey{}, slot)), slot
+}
+
+func (s *routeSlot) release() {
+	if s.u != nil {
+		s.u.active.Add(-1)
+		s.u = nil
+	}
+}
+
+// pickUpstream picks upstream from pool and accounts it as active while request is in flight
+func (s *routeSlot) pickUpstream() *Upstream {
+	s.release()
+	s.u = s.route.Pool.Pick()
+	s.u.active.Add(1)
+	return s.u
+}
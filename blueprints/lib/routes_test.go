@@ -0,0 +1,116 @@
+package lib_test
+
+import (
+	"io"
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func testMetrics() *lib.Metrics {
+	return &lib.Metrics{
+		RequestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "r"}, []string{"domain", "status"}),
+		BlockedTotal:  prometheus.NewCounterVec(prometheus.CounterOpts{Name: "b"}, []string{"type", "ip"}),
+		InspectedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{Name: "i"}, []string{"rule", "action"}),
+		ListHits: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "l"}, []string{"list", "action"}),
+	}
+}
+
+func echoServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, name+" "+r.URL.Path)
+	}))
+}
+
+func TestRouteRules(t *testing.T) {
+	api := echoServer("api")
+	defer api.Close()
+	ml := echoServer("ml")
+	defer ml.Close()
+	web := echoServer("web")
+	defer web.Close()
+
+	rules, err := lib.ParseRules(
+		"/api/ "+api.URL+"; /ml/ POST strip "+ml.URL+"; ~^/s/([a-z]+)$ GET rewrite=/share/$1 "+api.URL, lib.LBRoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, _ := lib.ParseTargets(web.URL)
+	routes := lib.NewRouteTable()
+	_ = routes.Add("im.example.top", rules...)
+	_ = routes.Add("im.example.top", &lib.Route{Prefix: "/", Pool: lib.NewPool(lib.LBRoundRobin, targets)})
+
+	vars := &lib.EnvVars{BucketLimit: 100, BucketRate: 10, BucketIdle: time.Minute}
+	blocker := lib.NewIPBlocker(4, time.Hour, lib.JailPolicy{}, 0)
+	srv := httptest.NewServer(lib.InitServer(blocker, lib.NewBucket(vars), vars, testMetrics(), routes, nil, nil).Handler)
+	defer srv.Close()
+
+	tests := []struct {
+		method, path, want string
+	}{
+		{http.MethodGet, "/api/assets", "api /api/assets"},
+		{http.MethodPost, "/ml/predict", "ml /predict"},
+		{http.MethodGet, "/ml/predict", "web /ml/predict"},
+		{http.MethodGet, "/s/abc", "api /share/abc"},
+		{http.MethodGet, "/photos", "web /photos"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, srv.URL+tt.path, nil)
+		req.Host = "im.example.top"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != tt.want {
+			t.Errorf("%s %s routed to %q, expected %q", tt.method, tt.path, body, tt.want)
+		}
+	}
+}
+
+func TestHostPrecedence(t *testing.T) {
+	routes := lib.NewRouteTable()
+	add := func(host string) {
+		if err := routes.Add(host, &lib.Route{Prefix: "/", Name: host}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("~^[a-z]+\\.example\\.top$")
+	add("*.example.top")
+	add("*.apps.example.top")
+	add("api.apps.example.top")
+
+	tests := map[string]string{
+		"api.apps.example.top":   "api.apps.example.top",
+		"API.apps.example.top":   "api.apps.example.top",
+		"web.apps.example.top":   "*.apps.example.top",
+		"a.web.apps.example.top": "*.apps.example.top",
+		"im.example.top":         "*.example.top",
+		"example.top":            "",
+		"apps.example.top":       "*.example.top",
+	}
+	for host, want := range tests {
+		got := ""
+		if r := routes.Match(host, http.MethodGet, "/"); r != nil {
+			got = r.Name
+		}
+		if got != want {
+			t.Errorf("host %s resolved to %q, expected %q", host, got, want)
+		}
+	}
+
+	regexOnly := lib.NewRouteTable()
+	_ = regexOnly.Add("~^(im|ha)\\.example\\.top$", &lib.Route{Prefix: "/", Name: "re"})
+	if r := regexOnly.Match("ha.example.top", http.MethodGet, "/"); r == nil || r.Name != "re" {
+		t.Error("regex host not matched")
+	}
+	if r := regexOnly.Match("xx.example.top", http.MethodGet, "/"); r != nil {
+		t.Error("regex host matched unexpected host")
+	}
+}
@@ -4,14 +4,16 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func InitMetrics(ipBlocker ClientFilter) (*http.Server, *Metrics) {
+// InitMetrics creates metrics server, admin api is served on it too unless nil
+func InitMetrics(
+	ipBlocker ClientFilter, routes *RouteTable, lists *AccessLists, admin http.Handler,
+) (*http.Server, *Metrics) {
 	requestsTotal := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "http_requests_total",
@@ -28,18 +30,47 @@ func InitMetrics(ipBlocker ClientFilter) (*http.Server, *Metrics) {
 		[]string{"type", "ip"},
 	)
 
-	prometheus.MustRegister(requestsTotal, blockedTotal)
+	inspectedTotal := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "inspection_matches_total",
+			Help: "Requests matched by inspection rules, labeled by rule and action",
+		},
+		[]string{"rule", "action"},
+	)
+
+	listHits := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "access_list_hits_total",
+			Help: "Requests matched by allow or deny lists, labeled by list and action",
+		},
+		[]string{"list", "action"},
+	)
+
+	tracked := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "ip_blocker_tracked_entries",
+			Help: "Number of ips tracked by ip blocker",
+		},
+		func() float64 { return float64(ipBlocker.Len()) },
+	)
+
+	prometheus.MustRegister(
+		requestsTotal, blockedTotal, inspectedTotal, listHits, tracked,
+		newPoolCollector(routes.Routes()), newFeedCollector(lists.Feeds()),
+	)
 	metr := &Metrics{
-		RequestsTotal: requestsTotal,
-		BlockedTotal:  blockedTotal,
+		RequestsTotal:  requestsTotal,
+		BlockedTotal:   blockedTotal,
+		InspectedTotal: inspectedTotal,
+		ListHits:       listHits,
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/clearip", func(w http.ResponseWriter, _ *http.Request) {
-		w.WriteHeader(http.StatusAccepted)
-		ipBlocker.Reset()
-	})
+	mux.Handle("/blocklist/", NewBlocklistHandler(ipBlocker, lists))
+	if admin != nil {
+		mux.Handle("/admin/", admin)
+	}
 
 	return &http.Server{
 		Addr:              ":8080",
@@ -50,9 +81,20 @@ func InitMetrics(ipBlocker ClientFilter) (*http.Server, *Metrics) {
 	}, metr
 }
 
-func InitServer(ipb ClientFilter, vars *EnvVars, me *Metrics, rt map[string]url.URL) *http.Server {
-	bucket := NewTokenBucket(vars.BucketLimit, vars.BucketRate)
+// NewBucket creates per client buckets with optional global cap
+func NewBucket(vars *EnvVars) Bucket {
+	var global Bucket
+	if vars.GlobalLimit > 0 {
+		global = NewGCRA(vars.GlobalRate, vars.GlobalLimit, nil)
+	}
+	return NewClientBuckets(func() Bucket {
+		return NewGCRA(vars.BucketRate, vars.BucketLimit, nil)
+	}, vars.BucketIdle, global, nil)
+}
 
+func InitServer(
+	ipb ClientFilter, bucket Bucket, vars *EnvVars, me *Metrics, rt *RouteTable, in *Inspector, al *AccessLists,
+) *http.Server {
 	proxy := &httputil.ReverseProxy{
 		Transport: &http.Transport{
 			DialContext: (&net.Dialer{
@@ -64,14 +106,20 @@ func InitServer(ipb ClientFilter, vars *EnvVars, me *Metrics, rt map[string]url.
 			ExpectContinueTimeout: 1 * time.Second,
 		},
 		Rewrite: func(r *httputil.ProxyRequest) {
-			target := rt[CutPort(r.In.Host)]
+			slot, ok := r.In.Context().Value(routeCtxKey{}).(*routeSlot)
+			if !ok {
+				return
+			}
+			target := slot.pickUpstream().URL
+			r.Out.URL.Path = slot.route.RewritePath(r.In.URL.Path)
+			r.Out.URL.RawPath = ""
 			r.SetURL(&target)
 			r.Out.Header["X-Forwarded-For"] = r.In.Header["X-Forwarded-For"]
 			r.SetXForwarded()
 		},
 	}
 
-	handler := NewRouter(proxy, bucket, ipb, me, rt)
+	handler := NewRouter(proxy, bucket, ipb, me, rt, vars.TrustedProxies, NewBlockResponses(vars), in, al)
 
 	return &http.Server{
 		Addr:              ":80",
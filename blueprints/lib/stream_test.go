@@ -0,0 +1,109 @@
+package lib_test
+
+import (
+	"bufio"
+	"io"
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func proxyTo(t *testing.T, backend string) (*httptest.Server, *lib.Metrics) {
+	t.Helper()
+	targets, _ := lib.ParseTargets(backend)
+	routes := lib.NewRouteTable()
+	_ = routes.Add("ha.example.top", &lib.Route{Prefix: "/", Pool: lib.NewPool(lib.LBRoundRobin, targets)})
+
+	m := testMetrics()
+	vars := &lib.EnvVars{BucketLimit: 10, BucketRate: 1, BucketIdle: time.Minute}
+	blocker := lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{}, 0)
+	return httptest.NewServer(lib.InitServer(blocker, lib.NewBucket(vars), vars, m, routes, nil, nil).Handler), m
+}
+
+func TestWebsocketThroughRouter(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = brw.Flush()
+		_, _ = io.Copy(conn, brw)
+	}))
+	defer backend.Close()
+	srv, m := proxyTo(t, backend.URL)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, _ = io.WriteString(conn, "GET /api/websocket HTTP/1.1\r\nHost: ha.example.top\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade failed with %d", resp.StatusCode)
+	}
+
+	for _, msg := range []string{"ping\n", "pong\n"} {
+		_, _ = io.WriteString(conn, msg)
+		got, err := br.ReadString('\n')
+		if err != nil || got != msg {
+			t.Fatalf("echo got %q %v, expected %q", got, err, msg)
+		}
+	}
+
+	if v := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("ha.example.top", "101")); v != 1 {
+		t.Errorf("upgrade counted %v times", v)
+	}
+	if n := testutil.CollectAndCount(m.BlockedTotal); n != 0 {
+		t.Errorf("upgrade counted as strike %d times", n)
+	}
+}
+
+func TestSSEThroughRouter(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: hello\n\n")
+		_ = http.NewResponseController(w).Flush()
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+	srv, _ := proxyTo(t, backend.URL)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/stream", nil)
+	req.Host = "ha.example.top"
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "data: hello" {
+		t.Fatalf("event not streamed: %q %v", line, err)
+	}
+}
@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var ErrStrikeRule = errors.New("invalid strike rule")
+
+type statusWeight struct {
+	from, to int
+	weight   float64
+}
+
+type strikeRule struct {
+	path    string
+	weights []statusWeight
+}
+
+func (r *strikeRule) matchPath(p string) bool {
+	if r.path == "" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(r.path, "*"); ok {
+		return strings.HasPrefix(p, prefix)
+	}
+	ok, _ := path.Match(r.path, p)
+	return ok
+}
+
+// StrikePolicy classifies upstream responses into strikes against the client.
+// First rule matching both path and status decides the weight, unmatched statuses don't count.
+type StrikePolicy struct {
+	rules []strikeRule
+}
+
+// Weight returns how much response counts towards blocking the client, nil policy counts every
+// status above 399 fully
+func (s *StrikePolicy) Weight(p string, status int) float64 {
+	if s == nil {
+		if status >= http.StatusBadRequest {
+			return 1
+		}
+		return 0
+	}
+
+	for i := range s.rules {
+		if !s.rules[i].matchPath(p) {
+			continue
+		}
+		for _, w := range s.rules[i].weights {
+			if status >= w.from && status <= w.to {
+				return w.weight
+			}
+		}
+	}
+	return 0
+}
+
+// ParseStrikePolicy parses ';' separated rules in form "[path] <codes>=<weight> ...", path may end
+// with '*' to match a prefix, codes are comma separated statuses, ranges (400-404) or classes (4xx),
+// e.g. "/auth/* 401,403=1; 404=0.2; 4xx=1; 5xx=0"
+func ParseStrikePolicy(spec string) (*StrikePolicy, error) {
+	s := &StrikePolicy{}
+	for rule := range strings.SplitSeq(spec, ";") {
+		f := strings.Fields(rule)
+		if len(f) == 0 {
+			continue
+		}
+
+		var r strikeRule
+		if strings.HasPrefix(f[0], "/") {
+			r.path, f = f[0], f[1:]
+		}
+		if len(f) == 0 {
+			return nil, errors.Join(ErrStrikeRule, errors.New(rule))
+		}
+
+		for _, cw := range f {
+			codes, ws, ok := strings.Cut(cw, "=")
+			if !ok {
+				return nil, errors.Join(ErrStrikeRule, errors.New(cw))
+			}
+			weight, err := strconv.ParseFloat(ws, 64)
+			if err != nil {
+				return nil, errors.Join(ErrStrikeRule, err)
+			}
+			for c := range strings.SplitSeq(codes, ",") {
+				from, to, err := parseStatusRange(c)
+				if err != nil {
+					return nil, errors.Join(ErrStrikeRule, err)
+				}
+				r.weights = append(r.weights, statusWeight{from: from, to: to, weight: weight})
+			}
+		}
+		s.rules = append(s.rules, r)
+	}
+	return s, nil
+}
+
+func parseStatusRange(c string) (int, int, error) {
+	if class, ok := strings.CutSuffix(strings.ToLower(c), "xx"); ok {
+		n, err := strconv.Atoi(class)
+		return n * 100, n*100 + 99, err
+	}
+	if from, to, ok := strings.Cut(c, "-"); ok {
+		f, err := strconv.Atoi(from)
+		if err != nil {
+			return 0, 0, err
+		}
+		t, err := strconv.Atoi(to)
+		return f, t, err
+	}
+	n, err := strconv.Atoi(c)
+	return n, n, err
+}
@@ -0,0 +1,44 @@
+package lib_test
+
+import (
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"testing"
+)
+
+func TestStrikePolicy(t *testing.T) {
+	s, err := lib.ParseStrikePolicy("/auth/* 401,403=1 404=0.5; /api/?/login 400-499=2; 404=0.2; 4xx=1; 5xx=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+		want   float64
+	}{
+		{"/auth/login", 401, 1},
+		{"/auth/login", 404, 0.5},
+		{"/auth/login", 400, 1},
+		{"/api/v/login", 418, 2},
+		{"/api/thumbnail/1", 404, 0.2},
+		{"/api/thumbnail/1", 403, 1},
+		{"/api/thumbnail/1", 502, 0},
+		{"/", 200, 0},
+	}
+	for _, tt := range tests {
+		if got := s.Weight(tt.path, tt.status); got != tt.want {
+			t.Errorf("%s %d weighs %v, expected %v", tt.path, tt.status, got, tt.want)
+		}
+	}
+
+	var legacy *lib.StrikePolicy
+	if legacy.Weight("/", 500) != 1 || legacy.Weight("/", 302) != 0 {
+		t.Error("nil policy should count every error status")
+	}
+
+	for _, bad := range []string{"/auth/*", "401", "4x=1", "401=a"} {
+		if _, err := lib.ParseStrikePolicy(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies is a list of proxy networks whose forwarding headers are honoured
+type TrustedProxies []netip.Prefix
+
+func (t TrustedProxies) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range t {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAddr walks forwarded chain right-to-left and returns first hop which is not trusted,
+// peer is direct connection address
+func (t TrustedProxies) ClientAddr(peer netip.Addr, xff []string, xRealIP string) netip.Addr {
+	if !t.Contains(peer) {
+		return peer
+	}
+
+	hops := make([]string, 0, len(xff))
+	for _, h := range xff {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := ParseHostAddr(hops[i])
+		if err != nil {
+			return client
+		}
+		client = addr
+		if !t.Contains(client) {
+			return client
+		}
+	}
+	if len(hops) > 0 {
+		return client
+	}
+
+	if addr, err := ParseHostAddr(xRealIP); err == nil {
+		return addr
+	}
+	return peer
+}
+
+// ParseHostAddr parses address with optional port as found in forwarding headers, e.g.
+// "2001:db8::1", "[2001:db8::1]:443" or "192.0.2.1:80", IPv4-mapped addresses are unmapped
+func ParseHostAddr(v string) (netip.Addr, error) {
+	v = strings.TrimSpace(v)
+	if ap, err := netip.ParseAddrPort(v); err == nil {
+		return ap.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(v, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
@@ -0,0 +1,40 @@
+package lib_test
+
+import (
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"net/netip"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	trusted := lib.TrustedProxies{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}
+
+	tests := []struct {
+		name string
+		peer string
+		xff  []string
+		real string
+		want string
+	}{
+		{"untrusted peer", "192.0.2.1", []string{"198.51.100.1"}, "198.51.100.2", "192.0.2.1"},
+		{"no headers", "10.0.0.1", nil, "", "10.0.0.1"},
+		{"single hop", "10.0.0.1", []string{"192.0.2.7"}, "", "192.0.2.7"},
+		// left hops are set by client and can't be trusted
+		{"right to left", "10.0.0.1", []string{"198.51.100.1, 192.0.2.7, 10.0.0.2"}, "", "192.0.2.7"},
+		{"header lines", "10.0.0.1", []string{"198.51.100.1", "192.0.2.7, fd00::2"}, "", "192.0.2.7"},
+		{"all trusted", "10.0.0.1", []string{"10.0.0.3, fd00::2, 10.0.0.2"}, "", "10.0.0.3"},
+		{"unparsable hop", "10.0.0.1", []string{"192.0.2.7, unknown, 10.0.0.2"}, "", "10.0.0.2"},
+		{"unparsable last hop", "10.0.0.1", []string{"192.0.2.7, unknown"}, "", "10.0.0.1"},
+		{"empty hop", "10.0.0.1", []string{"192.0.2.7,"}, "", "10.0.0.1"},
+		{"mapped peer", "::ffff:10.0.0.1", []string{"192.0.2.7"}, "", "192.0.2.7"},
+		{"real ip", "10.0.0.1", nil, "192.0.2.8", "192.0.2.8"},
+		{"real ip ignored with xff", "10.0.0.1", []string{"192.0.2.7"}, "192.0.2.8", "192.0.2.7"},
+		{"unparsable real ip", "10.0.0.1", nil, "unknown", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		got := trusted.ClientAddr(netip.MustParseAddr(tt.peer), tt.xff, tt.real).String()
+		if got != tt.want {
+			t.Errorf("%s: got %s want %s", tt.name, got, tt.want)
+		}
+	}
+}
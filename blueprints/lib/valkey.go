@@ -0,0 +1,610 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	valkeyTimeout = 500 * time.Millisecond
+	// valkeyBulkTimeout bounds operations over all records, which don't affect the breaker
+	valkeyBulkTimeout = 10 * time.Second
+	valkeyProbe       = 5 * time.Second
+	valkeyBatch       = 1000
+)
+
+// NewValkeyClient creates client without retries, calls are bounded by their context deadline and
+// failures fall back to local state
+func NewValkeyClient(vars *EnvVars) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:                  vars.ValkeyAddr,
+		Password:              vars.ValkeyPassword,
+		DB:                    vars.ValkeyDB,
+		MaxRetries:            -1,
+		ContextTimeoutEnabled: true,
+	})
+}
+
+// ValkeyStore keeps state as json under single key
+type ValkeyStore struct {
+	client redis.UniversalClient
+	key    string
+}
+
+func NewValkeyStore(client redis.UniversalClient, key string) *ValkeyStore {
+	return &ValkeyStore{client: client, key: key}
+}
+
+func (v *ValkeyStore) Save(ctx context.Context, entries []BlockEntry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return v.client.Set(ctx, v.key, data, 0).Err()
+}
+
+func (v *ValkeyStore) Load(ctx context.Context) ([]BlockEntry, error) {
+	data, err := v.client.Get(ctx, v.key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []BlockEntry
+	return entries, json.Unmarshal(data, &entries)
+}
+
+// errValkeySkipped marks calls not made while valkey is down
+var errValkeySkipped = errors.New("valkey skipped")
+
+// valkeyFallback is circuit breaker tracking reachability of valkey. After failure valkey is skipped
+// for Probe and local state is used, then single call probes it again. Only state changes are logged.
+type valkeyFallback struct {
+	// Probe is time between attempts to reach valkey while it is down, valkeyProbe when zero
+	Probe time.Duration
+
+	down  atomic.Bool
+	retry atomic.Int64
+}
+
+// skip reports if valkey is down and not due for probe, caller has to use local state
+func (f *valkeyFallback) skip() bool {
+	if !f.down.Load() {
+		return false
+	}
+	retry, now := f.retry.Load(), time.Now().UnixNano()
+	// only the caller moving retry forward probes, others keep using local state
+	return now < retry || !f.retry.CompareAndSwap(retry, now+int64(f.probe()))
+}
+
+func (f *valkeyFallback) probe() time.Duration {
+	if f.Probe <= 0 {
+		return valkeyProbe
+	}
+	return f.Probe
+}
+
+// failed reports if operation should fall back to local state
+func (f *valkeyFallback) failed(err error) bool {
+	if errors.Is(err, errValkeySkipped) {
+		return true
+	}
+	if err == nil || errors.Is(err, redis.Nil) {
+		if f.down.Swap(false) {
+			slog.Info("valkey reachable, using shared state")
+		}
+		return false
+	}
+	f.retry.Store(time.Now().Add(f.probe()).UnixNano())
+	if !f.down.Swap(true) {
+		slog.Error("valkey unreachable, using local state", "val", err.Error(), "probe", f.probe())
+	}
+	return true
+}
+
+// bulkFailed reports if operation over all records should fall back to local state, unlike failed
+// it doesn't mark valkey down, slow listing of large keyspace says nothing about request path
+func (f *valkeyFallback) bulkFailed(err error) bool {
+	if err == nil || errors.Is(err, redis.Nil) {
+		return false
+	}
+	if !errors.Is(err, errValkeySkipped) {
+		slog.Warn("valkey bulk operation failed, using local state", "val", err.Error())
+	}
+	return true
+}
+
+// blockerScript mirrors IPBlocker.NotifyFailure and Ban on a hash per ip, times are in ms,
+// explicit ban duration of zero escalates by jail durations passed after it. Second key is index
+// of records scored by their expiry.
+var blockerScript = redis.NewScript(`
+local now, weight, limit = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local reset, memory, force, reason = tonumber(ARGV[4]), tonumber(ARGV[5]), ARGV[6] == '1', ARGV[7]
+local dur = tonumber(ARGV[8])
+local r = redis.call('HMGET', KEYS[1], 'counter', 'last', 'offences', 'banned_at', 'until')
+local counter, last = tonumber(r[1]) or 0, tonumber(r[2]) or 0
+local offences, banned_at, untl = tonumber(r[3]) or 0, tonumber(r[4]) or 0, tonumber(r[5]) or 0
+if untl > now and not force then
+  return {untl, 0, offences}
+end
+if not force then
+  if now - last > reset then counter = weight else counter = counter + weight end
+  last = now
+end
+local banned = 0
+if force or counter > limit then
+  if memory > 0 and now - banned_at > memory then offences = 0 end
+  offences = offences + 1
+  local jail = #ARGV - 8
+  if dur <= 0 then dur = tonumber(ARGV[8 + math.min(offences, jail)]) end
+  counter, banned_at, banned = 0, now, 1
+  untl = now + dur
+  redis.call('HSET', KEYS[1], 'reason', reason)
+end
+redis.call('HSET', KEYS[1], 'counter', counter, 'last', last, 'offences', offences, 'banned_at', banned_at, 'until', untl)
+local keep = math.max(untl - now, reset)
+if offences > 0 and memory > 0 then keep = math.max(keep, banned_at + memory - now) end
+redis.call('PEXPIRE', KEYS[1], math.ceil(keep))
+redis.call('ZADD', KEYS[2], now + math.ceil(keep), KEYS[1])
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+return {untl, banned, offences}
+`)
+
+// ValkeyBlocker is ClientFilter shared by all replicas, local blocker is used while valkey is unreachable.
+// Records are indexed in sorted set scored by expiry, so listing them doesn't scan whole keyspace.
+type ValkeyBlocker struct {
+	client redis.UniversalClient
+	prefix string
+	index  string
+	local  *IPBlocker
+	valkeyFallback
+}
+
+// NewValkeyBlocker creates shared blocker with limits and jail policy of local blocker
+func NewValkeyBlocker(client redis.UniversalClient, prefix string, local *IPBlocker) *ValkeyBlocker {
+	return &ValkeyBlocker{client: client, prefix: prefix + ":ip:", index: prefix + ":ips", local: local}
+}
+
+func (v *ValkeyBlocker) NotifyFailure(ip string, weight float64) time.Duration {
+	banned, local := v.run(ip, weight, false, 0, "strike limit")
+	if local {
+		return v.local.NotifyFailure(ip, weight)
+	}
+	return banned
+}
+
+func (v *ValkeyBlocker) Ban(ip string, d time.Duration, reason string) {
+	if _, local := v.run(ip, 0, true, d, reason); local {
+		v.local.Ban(ip, d, reason)
+	}
+}
+
+// run executes blocker script, returns length of ban it started and true if local state has to be
+// used instead
+func (v *ValkeyBlocker) run(
+	ip string, weight float64, force bool, d time.Duration, reason string,
+) (time.Duration, bool) {
+	if v.skip() {
+		return 0, true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), valkeyTimeout)
+	defer cancel()
+
+	b := v.local
+	args := make([]any, 0, 8+len(b.jail.Durations))
+	args = append(args, time.Now().UnixMilli(), weight, b.limit, b.resetDur.Milliseconds(),
+		b.jail.Memory.Milliseconds(), boolArg(force), reason, d.Milliseconds())
+	for _, d := range b.jail.Durations {
+		args = append(args, d.Milliseconds())
+	}
+
+	res, err := blockerScript.Run(ctx, v.client, []string{v.prefix + ip, v.index}, args...).Int64Slice()
+	if v.failed(err) {
+		return 0, true
+	}
+	if len(res) != 3 || res[1] != 1 {
+		return 0, false
+	}
+	until := time.UnixMilli(res[0])
+	slog.Warn("ip banned", lIP, ip, "reason", reason, "offences", res[2], "until", until)
+	// script clock is ours, ban is at least a millisecond long
+	return max(time.Until(until), time.Millisecond), false
+}
+
+func (v *ValkeyBlocker) until(ip string) (time.Time, bool) {
+	if v.skip() {
+		return time.Time{}, false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), valkeyTimeout)
+	defer cancel()
+
+	ms, err := v.client.HGet(ctx, v.prefix+ip, "until").Int64()
+	if v.failed(err) {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms), true
+}
+
+func (v *ValkeyBlocker) CheckBlocked(ip string) bool {
+	until, ok := v.until(ip)
+	if !ok {
+		return v.local.CheckBlocked(ip)
+	}
+	return time.Now().Before(until)
+}
+
+func (v *ValkeyBlocker) BannedFor(ip string) time.Duration {
+	until, ok := v.until(ip)
+	if !ok {
+		return v.local.BannedFor(ip)
+	}
+	return max(time.Until(until), 0)
+}
+
+func (v *ValkeyBlocker) Reset() {
+	v.local.Reset()
+	keys, err := v.keys()
+	if v.bulkFailed(err) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), valkeyBulkTimeout)
+	defer cancel()
+	for batch := range slices.Chunk(append(keys, v.index), valkeyBatch) {
+		if err = v.client.Del(ctx, batch...).Err(); v.bulkFailed(err) {
+			return
+		}
+	}
+}
+
+// Unban removes shared and local records overlapping p, local records mostly mirror shared ones
+// so the larger of both counts is reported
+func (v *ValkeyBlocker) Unban(p netip.Prefix) int {
+	n := v.local.Unban(p)
+	keys, err := v.keys()
+	if v.bulkFailed(err) {
+		return n
+	}
+
+	var matched []string
+	for _, k := range keys {
+		if key, err := ParsePrefix(strings.TrimPrefix(k, v.prefix)); err == nil && p.Overlaps(key) {
+			matched = append(matched, k)
+		}
+	}
+	if len(matched) == 0 {
+		return n
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), valkeyBulkTimeout)
+	defer cancel()
+	shared := 0
+	for batch := range slices.Chunk(matched, valkeyBatch) {
+		pipe := v.client.Pipeline()
+		del := pipe.Del(ctx, batch...)
+		pipe.ZRem(ctx, v.index, anySlice(batch)...)
+		if _, err = pipe.Exec(ctx); v.bulkFailed(err) {
+			return max(n, shared)
+		}
+		shared += int(del.Val())
+	}
+	if shared > 0 {
+		slog.Warn("ip unbanned", lIP, p.String(), "records", shared)
+	}
+	return max(n, shared)
+}
+
+// List returns shared records, local ones while valkey is unreachable
+func (v *ValkeyBlocker) List() []BlockEntry {
+	keys, err := v.keys()
+	if v.bulkFailed(err) {
+		return v.local.List()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), valkeyBulkTimeout)
+	defer cancel()
+
+	entries := make([]BlockEntry, 0, len(keys))
+	for batch := range slices.Chunk(keys, valkeyBatch) {
+		pipe := v.client.Pipeline()
+		cmds := make([]*redis.SliceCmd, 0, len(batch))
+		for _, k := range batch {
+			cmds = append(cmds, pipe.HMGet(ctx, k, "counter", "last", "offences", "banned_at", "until", "reason"))
+		}
+		if _, err = pipe.Exec(ctx); v.bulkFailed(err) {
+			return v.local.List()
+		}
+		for i, cmd := range cmds {
+			r := cmd.Val()
+			// record expired after it was listed
+			if len(r) != 6 || r[1] == nil {
+				continue
+			}
+			entries = append(entries, BlockEntry{
+				IP:       strings.TrimPrefix(batch[i], v.prefix),
+				Strikes:  hashFloat(r[0]),
+				LastFail: hashTime(r[1]),
+				Offences: int(hashFloat(r[2])),
+				BannedAt: hashTime(r[3]),
+				Until:    hashTime(r[4]),
+				Reason:   hashString(r[5]),
+			})
+		}
+	}
+	return entries
+}
+
+// keys returns keys of unexpired shared records
+func (v *ValkeyBlocker) keys() ([]string, error) {
+	if v.skip() {
+		return nil, errValkeySkipped
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), valkeyBulkTimeout)
+	defer cancel()
+	return v.client.ZRangeByScore(ctx, v.index, &redis.ZRangeBy{Min: unexpired(), Max: "+inf"}).Result()
+}
+
+// unexpired is index score range start excluding records expired by now
+func unexpired() string {
+	return "(" + strconv.FormatInt(time.Now().UnixMilli(), 10)
+}
+
+// Snapshot returns shared records with offences, local ones while valkey is unreachable
+func (v *ValkeyBlocker) Snapshot() []BlockEntry {
+	var entries []BlockEntry
+	for _, e := range v.List() {
+		if e.Offences > 0 {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// restoreScript writes record unless replicas already track it and indexes it, ARGV are hash
+// fields, ttl and current time in ms
+var restoreScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then return 0 end
+redis.call('HSET', KEYS[1], 'counter', ARGV[1], 'last', ARGV[2], 'offences', ARGV[3], 'banned_at', ARGV[4],
+  'until', ARGV[5], 'reason', ARGV[6])
+redis.call('PEXPIRE', KEYS[1], ARGV[7])
+redis.call('ZADD', KEYS[2], tonumber(ARGV[8]) + tonumber(ARGV[7]), KEYS[1])
+return 1
+`)
+
+// Restore adds unexpired entries to shared state, records present in valkey win. Entries go to local
+// state while valkey is unreachable.
+func (v *ValkeyBlocker) Restore(entries []BlockEntry) int {
+	if v.skip() {
+		return v.local.Restore(entries)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), valkeyTimeout)
+	defer cancel()
+
+	b := v.local
+	now := time.Now()
+	n := 0
+	for i, e := range entries {
+		keep := max(e.Until.Sub(now), b.resetDur-now.Sub(e.LastFail))
+		if e.Offences > 0 && b.jail.Memory > 0 {
+			keep = max(keep, e.BannedAt.Add(b.jail.Memory).Sub(now))
+		}
+		if keep <= 0 {
+			continue
+		}
+		added, err := restoreScript.Run(ctx, v.client, []string{v.prefix + e.IP, v.index}, e.Strikes,
+			msArg(e.LastFail), e.Offences, msArg(e.BannedAt), msArg(e.Until), e.Reason, keep.Milliseconds()+1,
+			now.UnixMilli()).Int()
+		if v.failed(err) {
+			return n + v.local.Restore(entries[i:])
+		}
+		n += added
+	}
+	return n
+}
+
+// Len returns number of unexpired shared records
+func (v *ValkeyBlocker) Len() int {
+	if v.skip() {
+		return v.local.Len()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), valkeyTimeout)
+	defer cancel()
+	n, err := v.client.ZCount(ctx, v.index, unexpired(), "+inf").Result()
+	if v.bulkFailed(err) {
+		return v.local.Len()
+	}
+	return int(n)
+}
+
+// bucketScript is token bucket with fractional refill on hashes, second key is optional global cap.
+// ARGV: now ms, capacity, rate/s, global capacity, global rate/s, idle ttl ms, consume flag.
+// Returns allowed, retry ms and remaining tokens, ms until full and global flag of the bucket with
+// less tokens left.
+var bucketScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local function load(key, cap, rate)
+  local r = redis.call('HMGET', key, 'tokens', 'ts')
+  local tokens, ts = tonumber(r[1]) or cap, tonumber(r[2]) or now
+  return math.min(cap, tokens + math.max(now - ts, 0) * rate / 1000)
+end
+local function wait(tokens, rate)
+  if tokens >= 1 or rate <= 0 then return 0 end
+  return (1 - tokens) * 1000 / rate
+end
+local function full(tokens, cap, rate)
+  if rate <= 0 then return 0 end
+  return (cap - tokens) * 1000 / rate
+end
+local cap, rate = tonumber(ARGV[2]), tonumber(ARGV[3])
+local gcap, grate = tonumber(ARGV[4]), tonumber(ARGV[5])
+local t = load(KEYS[1], cap, rate)
+local allowed, retry = t >= 1, wait(t, rate)
+local gt
+if #KEYS > 1 then
+  gt = load(KEYS[2], gcap, grate)
+  allowed = allowed and gt >= 1
+  retry = math.max(retry, wait(gt, grate))
+end
+local function state(ok, after)
+  if gt and gt < t then
+    return {ok, math.ceil(after), math.floor(gt), math.ceil(full(gt, gcap, grate)), 1}
+  end
+  return {ok, math.ceil(after), math.floor(t), math.ceil(full(t, cap, rate)), 0}
+end
+if ARGV[7] ~= '1' then
+  return state(0, retry)
+end
+if allowed then
+  t = t - 1
+  if gt then gt = gt - 1 end
+end
+redis.call('HSET', KEYS[1], 'tokens', t, 'ts', now)
+redis.call('PEXPIRE', KEYS[1], ARGV[6])
+if gt then
+  redis.call('HSET', KEYS[2], 'tokens', gt, 'ts', now)
+  redis.call('PEXPIRE', KEYS[2], ARGV[6])
+end
+if allowed then return state(1, 0) end
+return state(0, retry)
+`)
+
+// ValkeyBucket is per client token bucket shared by all replicas, with optional global cap,
+// local bucket is used while valkey is unreachable
+type ValkeyBucket struct {
+	client      redis.UniversalClient
+	prefix      string
+	capacity    int
+	rate        Rate
+	globalLimit int
+	globalRate  Rate
+	idle        time.Duration
+	local       Bucket
+	valkeyFallback
+}
+
+func NewValkeyBucket(client redis.UniversalClient, prefix string, vars *EnvVars, local Bucket) *ValkeyBucket {
+	return &ValkeyBucket{
+		client:      client,
+		prefix:      prefix + ":bucket:",
+		capacity:    vars.BucketLimit,
+		rate:        vars.BucketRate,
+		globalLimit: vars.GlobalLimit,
+		globalRate:  vars.GlobalRate,
+		idle:        max(vars.BucketIdle, time.Second),
+		local:       local,
+	}
+}
+
+func (v *ValkeyBucket) run(key string, consume bool) ([]int64, error) {
+	if v.skip() {
+		return nil, errValkeySkipped
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), valkeyTimeout)
+	defer cancel()
+
+	keys := []string{v.prefix + key}
+	if v.globalLimit > 0 {
+		keys = append(keys, v.prefix+"_global")
+	}
+	return bucketScript.Run(ctx, v.client, keys, time.Now().UnixMilli(), v.capacity, float64(v.rate),
+		v.globalLimit, float64(v.globalRate), v.idle.Milliseconds(), boolArg(consume)).Int64Slice()
+}
+
+func (v *ValkeyBucket) GetToken(key string) bool {
+	res, err := v.run(key, true)
+	if v.failed(err) || len(res) != 5 {
+		return v.local.GetToken(key)
+	}
+	return res[0] == 1
+}
+
+func (v *ValkeyBucket) RetryAfter(key string) time.Duration {
+	res, err := v.run(key, false)
+	if v.failed(err) || len(res) != 5 {
+		return v.local.RetryAfter(key)
+	}
+	return time.Duration(res[1]) * time.Millisecond
+}
+
+// Quota reports client bucket, or global one when it has less tokens left
+func (v *ValkeyBucket) Quota(key string) Quota {
+	res, err := v.run(key, false)
+	if v.failed(err) || len(res) != 5 {
+		return v.local.Quota(key)
+	}
+	return v.quota(res)
+}
+
+// Take consumes token and reports quota in single round trip
+func (v *ValkeyBucket) Take(key string) (bool, Quota) {
+	res, err := v.run(key, true)
+	if v.failed(err) || len(res) != 5 {
+		return v.local.Take(key)
+	}
+	return res[0] == 1, v.quota(res)
+}
+
+// quota converts bucket script result
+func (v *ValkeyBucket) quota(res []int64) Quota {
+	limit, rate := v.capacity, v.rate
+	if res[4] == 1 {
+		limit, rate = v.globalLimit, v.globalRate
+	}
+	return Quota{
+		Limit:      limit,
+		Window:     rate.Duration(float64(limit)),
+		Remaining:  int(res[2]),
+		Reset:      time.Duration(res[3]) * time.Millisecond,
+		RetryAfter: time.Duration(res[1]) * time.Millisecond,
+	}
+}
+
+func hashString(v any) string {
+	s, _ := v.(string)
+	return s
+}
+
+func hashFloat(v any) float64 {
+	f, _ := strconv.ParseFloat(hashString(v), 64)
+	return f
+}
+
+// hashTime converts ms timestamp, zero stays zero time
+func hashTime(v any) time.Time {
+	ms := int64(hashFloat(v))
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// msArg converts time to ms timestamp, zero time to zero
+func msArg(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func anySlice(s []string) []any {
+	res := make([]any, 0, len(s))
+	for _, v := range s {
+		res = append(res, v)
+	}
+	return res
+}
+
+func boolArg(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,263 @@
+package lib_test
+
+import (
+	"context"
+	"io"
+	"larenso/cluster_autmation/ratelimiter/lib"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestValkeyBlockerShared(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	jail := lib.JailPolicy{Durations: []time.Duration{time.Minute, time.Hour}, Memory: 24 * time.Hour}
+
+	// two replicas sharing valkey
+	local := lib.NewIPBlocker(3, time.Hour, jail, 0)
+	a := lib.NewValkeyBlocker(client, "rl", local)
+	b := lib.NewValkeyBlocker(client, "rl", lib.NewIPBlocker(3, time.Hour, jail, 0))
+	ip := "203.0.113.5"
+
+	a.NotifyFailure(ip, 1)
+	if d := b.NotifyFailure(ip, 1.5); d != 0 || a.CheckBlocked(ip) {
+		t.Fatal("banned before reaching limit")
+	}
+	if d := a.NotifyFailure(ip, 1); d <= 0 || d > time.Minute {
+		t.Errorf("strike reported ban of %v", d)
+	}
+	if !b.CheckBlocked(ip) {
+		t.Fatal("strikes are not shared between replicas")
+	}
+	// only the replica whose strike banned reports it
+	if d := b.NotifyFailure(ip, 1); d != 0 {
+		t.Errorf("strike during ban reported %v", d)
+	}
+	if d := b.BannedFor(ip); d <= 0 || d > time.Minute {
+		t.Errorf("first ban lasts %v", d)
+	}
+
+	a.Ban(ip, 0, "manual")
+	if d := b.BannedFor(ip); d <= time.Minute {
+		t.Errorf("second ban not escalated: %v", d)
+	}
+	b.Ban("203.0.113.6", 5*time.Minute, "manual")
+	if list := a.List(); len(list) != 2 || list[0].Offences == 0 || list[0].Until.IsZero() {
+		t.Errorf("unexpected shared list %+v", list)
+	}
+	if n := a.Unban(netip.MustParsePrefix("203.0.113.6/32")); n != 1 || b.CheckBlocked("203.0.113.6") {
+		t.Errorf("unban removed %d records", n)
+	}
+	if b.Len() != 1 {
+		t.Errorf("tracking %d ips", b.Len())
+	}
+	// records kept only locally, e.g. while valkey was down, are counted too
+	local.Ban("198.51.100.1", time.Minute, "manual")
+	if n := a.Unban(netip.MustParsePrefix("198.51.100.0/24")); n != 1 {
+		t.Errorf("unban of local record removed %d records", n)
+	}
+	b.Reset()
+	if a.CheckBlocked(ip) || a.Len() != 0 {
+		t.Error("reset didn't clear shared state")
+	}
+}
+
+func TestValkeyFallback(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := lib.NewValkeyClient(&lib.EnvVars{ValkeyAddr: mr.Addr()})
+	local := lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{}, 0)
+	v := lib.NewValkeyBlocker(client, "rl", local)
+	vars := &lib.EnvVars{BucketLimit: 1, BucketRate: 1, BucketIdle: time.Minute}
+	bucket := lib.NewValkeyBucket(client, "rl", vars, lib.NewBucket(vars))
+
+	mr.Close()
+	v.Ban("203.0.113.6", 0, "manual")
+	if !local.CheckBlocked("203.0.113.6") || !v.CheckBlocked("203.0.113.6") {
+		t.Error("ban not applied to local state while valkey is down")
+	}
+	if !bucket.GetToken("203.0.113.7") || bucket.GetToken("203.0.113.7") {
+		t.Error("local bucket not used while valkey is down")
+	}
+}
+
+// countHook counts commands sent by client
+type countHook struct {
+	n atomic.Int32
+}
+
+func (h *countHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *countHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.n.Add(1)
+		return next(ctx, cmd)
+	}
+}
+
+func (h *countHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestValkeyBucket(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	vars := &lib.EnvVars{BucketLimit: 2, BucketRate: 1, GlobalLimit: 3, GlobalRate: 1, BucketIdle: time.Minute}
+
+	a := lib.NewValkeyBucket(client, "rl", vars, lib.NewBucket(vars))
+	b := lib.NewValkeyBucket(client, "rl", vars, lib.NewBucket(vars))
+
+	if !a.GetToken("c1") || !b.GetToken("c1") {
+		t.Fatal("tokens within capacity denied")
+	}
+	if a.GetToken("c1") {
+		t.Fatal("capacity not shared between replicas")
+	}
+	if d := b.RetryAfter("c1"); d <= 0 || d > time.Second {
+		t.Errorf("retry after %v", d)
+	}
+	if q := b.Quota("c1"); q.Limit != 2 || q.Remaining != 0 || q.Window != 2*time.Second || q.Reset <= time.Second {
+		t.Errorf("client quota %+v", q)
+	}
+
+	// token and quota take single round trip
+	calls := &countHook{}
+	client.AddHook(calls)
+	if ok, q := a.Take("c1"); ok || q.Remaining != 0 || q.RetryAfter <= 0 || calls.n.Load() != 1 {
+		t.Errorf("take %+v in %d commands", q, calls.n.Load())
+	}
+
+	if !a.GetToken("c2") || b.GetToken("c3") {
+		t.Error("global cap not applied")
+	}
+	if q := a.Quota("c4"); q.Limit != 3 || q.Remaining != 0 {
+		t.Errorf("global quota not reported: %+v", q)
+	}
+}
+
+func TestValkeyBreaker(t *testing.T) {
+	// valkey accepting connections but never answering, each call runs into timeout
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(io.Discard, c) }()
+		}
+	}()
+
+	client := lib.NewValkeyClient(&lib.EnvVars{ValkeyAddr: l.Addr().String()})
+	defer client.Close()
+	v := lib.NewValkeyBlocker(client, "rl", lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{}, 0))
+	v.Probe = time.Hour
+	vars := &lib.EnvVars{BucketLimit: 100, BucketRate: 1, BucketIdle: time.Minute}
+	bucket := lib.NewValkeyBucket(client, "rl", vars, lib.NewBucket(vars))
+	bucket.Probe = time.Hour
+
+	// only the first call of each waits for valkey
+	start := time.Now()
+	for range 20 {
+		v.NotifyFailure("203.0.113.1", 0.01)
+		v.CheckBlocked("203.0.113.1")
+		v.BannedFor("203.0.113.1")
+		bucket.GetToken("203.0.113.1")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("fallback took %v", d)
+	}
+}
+
+func TestValkeyProbe(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := lib.NewValkeyClient(&lib.EnvVars{ValkeyAddr: mr.Addr()})
+	v := lib.NewValkeyBlocker(client, "rl", lib.NewIPBlocker(1, time.Hour, lib.JailPolicy{}, 0))
+	v.Probe = 50 * time.Millisecond
+
+	mr.Close()
+	v.Ban("203.0.113.1", 0, "manual")
+	if err := mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	// valkey is skipped until probe
+	v.Ban("203.0.113.2", 0, "manual")
+	if mr.Exists("rl:ip:203.0.113.2") {
+		t.Error("valkey called right after failure")
+	}
+	for deadline := time.Now().Add(2 * time.Second); !mr.Exists("rl:ip:203.0.113.3"); {
+		if time.Now().After(deadline) {
+			t.Fatal("valkey not probed again")
+		}
+		time.Sleep(10 * time.Millisecond)
+		v.Ban("203.0.113.3", 0, "manual")
+	}
+}
+
+func TestValkeySnapshot(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	jail := lib.JailPolicy{Memory: 24 * time.Hour}
+	a := lib.NewValkeyBlocker(client, "rl", lib.NewIPBlocker(3, time.Hour, jail, 0))
+
+	a.Ban("203.0.113.1", time.Hour, "manual")
+	a.NotifyFailure("203.0.113.2", 1)
+	snap := a.Snapshot()
+	if len(snap) != 1 || snap[0].IP != "203.0.113.1" || snap[0].Reason != "manual" {
+		t.Fatalf("shared snapshot %+v", snap)
+	}
+
+	mr.FlushAll()
+	b := lib.NewValkeyBlocker(client, "rl", lib.NewIPBlocker(3, time.Hour, jail, 0))
+	expired := lib.BlockEntry{IP: "203.0.113.3", Offences: 1, BannedAt: time.Now().Add(-48 * time.Hour),
+		Until: time.Now().Add(-47 * time.Hour)}
+	if n := b.Restore(append(snap, expired)); n != 1 || b.BannedFor("203.0.113.1") <= 59*time.Minute {
+		t.Errorf("restored %d, banned for %v", n, b.BannedFor("203.0.113.1"))
+	}
+	if mr.TTL("rl:ip:203.0.113.1") < 23*time.Hour {
+		t.Errorf("restored record expires in %v", mr.TTL("rl:ip:203.0.113.1"))
+	}
+	if a.Len() != 1 {
+		t.Errorf("tracking %d ips", a.Len())
+	}
+}
+
+func TestValkeyBulk(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := lib.NewValkeyClient(&lib.EnvVars{ValkeyAddr: mr.Addr()})
+	local := lib.NewIPBlocker(3, time.Second, lib.JailPolicy{}, 0)
+	v := lib.NewValkeyBlocker(client, "rl", local)
+
+	v.Ban("203.0.113.1", time.Hour, "manual")
+	v.Ban("203.0.113.2", time.Minute, "manual")
+	mr.Set("rl:ip:unrelated", "x")
+	// record expired in valkey before its index entry
+	mr.FastForward(2 * time.Minute)
+	if list := v.List(); len(list) != 1 || list[0].IP != "203.0.113.1" {
+		t.Errorf("listed %+v", list)
+	}
+
+	// failed bulk read falls back to local state but keeps request path on shared state
+	local.Ban("198.51.100.1", time.Hour, "local")
+	mr.SetError("LOADING")
+	if list := v.List(); len(list) != 1 || list[0].IP != "198.51.100.1" {
+		t.Errorf("listed %+v while valkey fails", list)
+	}
+	mr.SetError("")
+	if !v.CheckBlocked("203.0.113.1") {
+		t.Error("shared state skipped after failed bulk read")
+	}
+
+	if n := v.Unban(netip.MustParsePrefix("203.0.113.0/24")); n != 1 || v.Len() != 0 {
+		t.Errorf("unban removed %d records, %d left", n, v.Len())
+	}
+}
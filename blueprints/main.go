@@ -4,17 +4,22 @@ import (
 	"context"
 	"larenso/cluster_autmation/ratelimiter/lib"
 	"log/slog"
-	"net/url"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	env "github.com/caarlos0/env/v11"
 )
 
-func getRoutes() map[string]url.URL {
-	routes := make(map[string]url.URL)
+// getRoutes reads RO_SUB_DOMAIN=url1,url2 routes, path rules can be prepended with RP_SUB_DOMAIN,
+// balancing policy can be set per route with LB_SUB_DOMAIN, strike rules with SR_SUB_DOMAIN, rate
+// limit with RL_SUB_DOMAIN and host pattern (*.domain, ~regex) can replace the key derived host with
+// RH_SUB_DOMAIN
+func getRoutes(defPolicy string, defStrikes *lib.StrikePolicy) *lib.RouteTable {
+	routes := lib.NewRouteTable()
 	for _, envVar := range os.Environ() {
 		if !strings.HasPrefix(envVar, "RO_") {
 			continue
@@ -23,23 +28,76 @@ func getRoutes() map[string]url.URL {
 		if !f || len(k) < 4 {
 			continue
 		}
-		if !strings.HasPrefix(v, "http") {
-			v = "http://" + v
+
+		// cut RO_ , replace SUB_DOMAIN -> SUB.DOMAIN, to lowercase
+		host := strings.ToLower(strings.ReplaceAll(k[3:], "_", "."))
+		if h, ok := os.LookupEnv("RH_" + k[3:]); ok {
+			host = h
 		}
-		url, err := url.Parse(v)
+
+		policy := defPolicy
+		if p, ok := os.LookupEnv("LB_" + k[3:]); ok {
+			var err error
+			if policy, err = lib.ParseLBPolicy(p); err != nil {
+				slog.Error("parsing balancing policy, skipping", "val", err, "route", host)
+				continue
+			}
+		}
+
+		strikes := defStrikes
+		if sr, ok := os.LookupEnv("SR_" + k[3:]); ok {
+			var err error
+			if strikes, err = lib.ParseStrikePolicy(sr); err != nil {
+				slog.Error("parsing strike rules, skipping", "val", err, "route", host)
+				continue
+			}
+		}
+
+		var limit *lib.LimitPolicy
+		if rl, ok := os.LookupEnv("RL_" + k[3:]); ok {
+			var err error
+			if limit, err = lib.ParseLimitPolicy(rl); err != nil {
+				slog.Error("parsing rate limit, skipping", "val", err, "route", host)
+				continue
+			}
+		}
+
+		rules, err := lib.ParseRules(os.Getenv("RP_"+k[3:]), policy)
 		if err != nil {
-			slog.Error("parsing url, skippig", "val", err)
+			slog.Error("parsing rules, skipping", "val", err, "route", host)
+			continue
+		}
+		for _, r := range rules {
+			r.Strikes = strikes
+			if r.Limit == nil {
+				r.Limit = limit
+			}
+		}
+		if err = routes.Add(host, rules...); err != nil {
+			slog.Error("adding route, skipping", "val", err, "route", host)
 			continue
 		}
 
-		// cut RO_ , replace SUB_DOMAIN -> SUB.DOMAIN, to lowercase
-		routes[strings.ToLower(strings.ReplaceAll(k[3:], "_", "."))] = *url
+		targets, err := lib.ParseTargets(v)
+		if err != nil {
+			slog.Error("parsing url, skipping", "val", err, "route", host)
+			continue
+		}
+		route := &lib.Route{Prefix: "/", Pool: lib.NewPool(policy, targets), Strikes: strikes, Limit: limit}
+		if err = routes.Add(host, route); err != nil {
+			slog.Error("adding route, skipping", "val", err, "route", host)
+		}
 	}
 
 	return routes
 }
 
 func main() {
+	// ratelimiter <command> drives running server through admin api
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:], os.Stdout))
+	}
+
 	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
 
 	var vars lib.EnvVars
@@ -49,18 +107,128 @@ func main() {
 		return
 	}
 
-	routing := getRoutes()
+	strikes, err := lib.ParseStrikePolicy(vars.StrikeRules)
+	if err != nil {
+		slog.Error("Error parsing STRIKE_RULES", "val", err)
+		return
+	}
+	policy, err := lib.ParseLBPolicy(vars.LBPolicy)
+	if err != nil {
+		slog.Error("Error parsing LB_POLICY", "val", err)
+		return
+	}
+	routing := getRoutes(policy, strikes)
+
+	ipBlocker := lib.NewIPBlocker(vars.IPLimit, vars.IPDuration, lib.JailPolicy{
+		Durations: vars.IPJail,
+		Memory:    vars.IPJailMem,
+	}, vars.IPMaxTrack)
+	var filter lib.ClientFilter = ipBlocker
+	var snapshotter lib.Snapshotter = ipBlocker
+	bucket := lib.NewBucket(&vars)
+	if vars.SharedState {
+		valkey := lib.NewValkeyClient(&vars)
+		shared := lib.NewValkeyBlocker(valkey, vars.StateKey, ipBlocker)
+		sharedBucket := lib.NewValkeyBucket(valkey, vars.StateKey, &vars, bucket)
+		shared.Probe, sharedBucket.Probe = vars.ValkeyProbe, vars.ValkeyProbe
+		filter, snapshotter, bucket = shared, shared, sharedBucket
+	}
+	notifiers, err := lib.ParseNotifiers(vars.Notify, &vars)
+	if err != nil {
+		slog.Error("Error parsing NOTIFY", "val", err)
+		return
+	}
+	events := lib.NewEventBus(vars.StormThreshold, vars.StormWindow, notifiers...)
+	filter = lib.NewEventFilter(filter, events)
+	bucket = lib.NewEventBucket(bucket, events)
+	// strikes, bans and tokens are shared by client prefix, e.g. whole IPv6 /64
+	prefix := lib.ClientPrefix{V4: vars.PrefixV4, V6: vars.PrefixV6}
+	filter = lib.NewPrefixFilter(filter, prefix)
+	bucket = lib.NewPrefixBucket(bucket, prefix)
+	routing.InitLimits(vars.BucketIdle, func(b lib.Bucket) lib.Bucket {
+		return lib.NewPrefixBucket(lib.NewEventBucket(b, events), prefix)
+	})
 
-	ipBlocker := lib.NewIPBlocker(vars.IPLimit, vars.IPDuration)
-	metrics, metr := lib.InitMetrics(ipBlocker)
-	server := lib.InitServer(ipBlocker, &vars, metr, routing)
+	actx, acancel := context.WithTimeout(context.Background(), 10*time.Second)
+	lists, err := lib.LoadAccessLists(actx, &vars)
+	acancel()
+	if err != nil {
+		slog.Error("Error loading access lists", "val", err)
+		return
+	}
+
+	var admin, adminOnMetrics http.Handler
+	if len(vars.TrustedProxies) == 0 {
+		slog.Warn("TRUSTED_PROXIES not set, forwarding headers ignored, set it to gateway and node CIDRs")
+	}
+	if vars.AdminToken == "" {
+		slog.Warn("ADMIN_TOKEN not set, admin api disabled")
+	} else {
+		admin = lib.NewAdmin(filter, lists, routing, vars.AdminToken)
+	}
+	var adminSrv *http.Server
+	if admin != nil && vars.AdminAddr != "" {
+		adminSrv = lib.InitAdmin(vars.AdminAddr, admin)
+	} else {
+		adminOnMetrics = admin
+	}
+
+	metrics, metr := lib.InitMetrics(filter, routing, lists, adminOnMetrics)
+	var inspector *lib.Inspector
+	if vars.Inspect {
+		if inspector, err = lib.LoadInspector(vars.InspectRules); err != nil {
+			slog.Error("Error loading inspection rules", "val", err)
+			return
+		}
+		inspector.SetMaxTarpits(vars.MaxTarpits)
+	}
+	server := lib.InitServer(filter, bucket, &vars, metr, routing, inspector, lists)
+
+	store, persist, err := lib.NewStateStore(&vars)
+	if err != nil {
+		slog.Error("Error creating state store", "val", err)
+		return
+	}
 
 	errch := make(chan error, 1)
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	// kubelet stops pods with SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	var persister *lib.Persister
+	if persist {
+		persister = lib.NewPersister(snapshotter, store, vars.StateInterval)
+		rctx, rcancel := context.WithTimeout(ctx, 10*time.Second)
+		if err = persister.Restore(rctx); err != nil {
+			slog.Error("restoring blocker state", "val", err.Error())
+		}
+		rcancel()
+		go persister.Run(ctx)
+	}
+
+	exporter, export, err := lib.NewCiliumExporterFromEnv(filter, lists, &vars)
+	if err != nil {
+		slog.Error("Error creating cilium exporter", "val", err)
+		return
+	}
+	if export {
+		go exporter.Run(ctx)
+	}
+
+	go ipBlocker.Run(ctx, vars.IPSweep)
+	go events.Run(ctx)
+	go lists.Run(ctx, vars.ListReload)
+	lib.StartHealthChecks(ctx, routing.Routes(), vars.HealthPath, vars.HealthInterval, vars.HealthTimeout,
+		vars.HealthFails)
+
+	ln, err := lib.Listen(server.Addr, &vars)
+	if err != nil {
+		slog.Error("Error creating listener", "val", err)
+		return
+	}
+
 	go func() {
-		if err := server.ListenAndServe(); err != nil {
+		if err := server.Serve(ln); err != nil {
 			errch <- err
 		}
 	}()
@@ -71,6 +239,14 @@ func main() {
 		}
 	}()
 
+	if adminSrv != nil {
+		go func() {
+			if err := adminSrv.ListenAndServe(); err != nil {
+				errch <- err
+			}
+		}()
+	}
+
 	select {
 	case err = <-errch:
 		slog.Error(err.Error())
@@ -88,4 +264,19 @@ func main() {
 	if err = metrics.Shutdown(lctx); err != nil {
 		slog.Error("metric server shutdown error", "val", err.Error())
 	}
+
+	if adminSrv != nil {
+		if err = adminSrv.Shutdown(lctx); err != nil {
+			slog.Error("admin server shutdown error", "val", err.Error())
+		}
+	}
+
+	if persister != nil {
+		// servers may have used up shutdown timeout
+		sctx, scancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer scancel()
+		if err = persister.Save(sctx); err != nil {
+			slog.Error("saving blocker state", "val", err.Error())
+		}
+	}
 }